@@ -1,7 +1,38 @@
 package main
 
-import "github.com/tomial/go-db/internal/repl"
+import (
+	"log"
+	"os"
+	"strings"
 
+	"github.com/tomial/go-db/internal/constants"
+	"github.com/tomial/go-db/internal/repl"
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// Usage: godb [path] [journal_mode=delete|wal|off], godb check [path] [journal_mode=...]
+// The database file defaults to ./my.db
 func main() {
-	repl.Run()
+	args := os.Args[1:]
+	// godb check: verify the db file and exit, non-zero status if it's broken
+	check := len(args) > 0 && args[0] == "check"
+	if check {
+		args = args[1:]
+	}
+	path := constants.DbFileName
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		path = args[0]
+		args = args[1:]
+	}
+	options, err := storage.ParseOptions(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if check {
+		if !repl.Check(path, options) {
+			os.Exit(1)
+		}
+		return
+	}
+	repl.Run(path, options)
 }
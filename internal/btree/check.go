@@ -0,0 +1,332 @@
+package btree
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// A broken invariant found by Check, at the page it was found
+type Violation struct {
+	Page    PageNum
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("page %d: %s", v.Page, v.Message)
+}
+
+type checker struct {
+	bt         *BTree
+	violations []Violation
+	visited    map[PageNum]bool
+	leaves     []PageNum // leaves in key order
+	numNode    uint32
+	free       map[PageNum]bool
+}
+
+func (c *checker) report(page PageNum, format string, args ...any) {
+	c.violations = append(c.violations, Violation{Page: page, Message: fmt.Sprintf(format, args...)})
+}
+
+func newChecker(bt *BTree) *checker {
+	return &checker{bt: bt, visited: map[PageNum]bool{}, free: map[PageNum]bool{}}
+}
+
+// Walk every page from the root and verify the structure of the tree:
+// magic numbers, key order in and across nodes, separator keys against the
+// keys of their children, Parent pointers, node heights, the Next chain of
+// the leaves and NumNode.
+// For the tree on page 0, the tree page and the freelist are verified too,
+// and every page of the file must be either a free page or a node of the
+// tree or of the other trees of the file opened with OpenTree. The other
+// trees are only walked to find their nodes, Check them on their own.
+// Returns every violation found, nil for a sound tree.
+func (bt *BTree) Check(others ...*BTree) []Violation {
+	c := newChecker(bt)
+
+	if bt.file == bt {
+		if bt.pager.NumPages() == 0 {
+			c.report(0, "missing tree page")
+			return c.violations
+		}
+		treePage, err := bt.pager.ReadPage(0)
+		if err != nil {
+			c.report(0, "%s", err)
+			return c.violations
+		}
+		magicNumber := hex.EncodeToString(treePage[:constants.MagicNumberSize])
+		if magicNumber != constants.MagicNumberTree {
+			c.report(0, "invalid magic number %s, expected %s", magicNumber, constants.MagicNumberTree)
+		}
+	}
+
+	c.checkTree()
+	if bt.file != bt {
+		return c.violations
+	}
+
+	for _, other := range others {
+		oc := newChecker(other)
+		oc.checkTree()
+		for page := range oc.visited {
+			if c.visited[page] {
+				c.report(page, "node of two trees")
+			}
+			c.visited[page] = true
+		}
+	}
+	c.checkFreelist()
+	for page := PageNum(1); uint32(page) < bt.pager.NumPages(); page++ {
+		if !c.visited[page] && !c.free[page] {
+			c.report(page, "neither a node of the tree nor a free page")
+		}
+	}
+
+	return c.violations
+}
+
+// Check the nodes from the root, NumNode and the leaf chain
+func (c *checker) checkTree() {
+	bt := c.bt
+	if bt.Root == 0 {
+		if bt.NumNode != 0 || bt.First != 0 {
+			c.report(0, "empty tree with %d nodes and first leaf %d", bt.NumNode, bt.First)
+		}
+		return
+	}
+	c.checkNode(bt.Root, 0, nil, nil)
+
+	if c.numNode != bt.NumNode {
+		c.report(0, "NumNode is %d, found %d nodes", bt.NumNode, c.numNode)
+	}
+	c.checkLeafChain()
+}
+
+// Check the node and its subtree, keys must be in [low, high) when they are set.
+// Returns the height of the node counted from the leaves, -1 if it can't be read.
+func (c *checker) checkNode(page PageNum, parent PageNum, low, high *key) int {
+	if page == 0 || uint32(page) >= c.bt.pager.NumPages() {
+		c.report(parent, "child page %d is out of the file with %d pages", page, c.bt.pager.NumPages())
+		return -1
+	}
+	if c.visited[page] {
+		c.report(page, "referenced more than once, by %d again", parent)
+		return -1
+	}
+	c.visited[page] = true
+
+	bytes, err := c.bt.pager.ReadPage(uint32(page))
+	if err != nil {
+		c.report(page, "%s", err)
+		return -1
+	}
+	var n node
+	switch nodeType(bytes) {
+	case TypeLeaf:
+		ln := initEmptyLeafNode()
+		if err := ln.deserialize(bytes); err != nil {
+			c.report(page, "%s", err)
+			return -1
+		}
+		ln.btree = c.bt
+		n = ln
+	case TypeInternal:
+		in := initEmptyInternalNode()
+		if err := in.deserialize(bytes); err != nil {
+			c.report(page, "%s", err)
+			return -1
+		}
+		in.btree = c.bt
+		n = in
+	default:
+		c.report(page, "invalid magic number %s for a node", hex.EncodeToString(bytes[:constants.MagicNumberSize]))
+		return -1
+	}
+	c.numNode++
+
+	h := n.header()
+	if h.Page != page {
+		c.report(page, "header has page %d", h.Page)
+	}
+	if h.Parent != parent {
+		c.report(page, "parent is %d, expected %d", h.Parent, parent)
+	}
+	if parent == 0 && h.Typ != TypeRoot {
+		c.report(page, "root node has type %s", h.Typ)
+	}
+
+	var height int
+	switch n := n.(type) {
+	case *LeafNode:
+		height = c.checkLeaf(n, low, high)
+	case *InternalNode:
+		height = c.checkInternal(n, low, high)
+	}
+	if height >= 0 && int(h.Height) != height {
+		c.report(page, "height is %d, expected %d", h.Height, height)
+	}
+	return height
+}
+
+func (c *checker) checkLeaf(ln *LeafNode, low, high *key) int {
+	page := ln.Header.Page
+	c.leaves = append(c.leaves, page)
+
+	if ln.Header.Parent != 0 && ln.Header.Typ != TypeLeaf {
+		c.report(page, "leaf node has type %s", ln.Header.Typ)
+	}
+	if ln.Header.Parent != 0 && ln.usedBytes() < minLeafBytes() {
+		c.report(page, "%d bytes used, less than the minimum %d", ln.usedBytes(), minLeafBytes())
+	}
+
+	for i := 0; i < int(ln.Header.NumCell); i++ {
+		k := ln.Cells[i].key
+		if size := len(ln.Cells[i].data); uint32(size) > MaxDataSize() {
+			c.report(page, "key %d has %d bytes of data, more than the maximum %d", k, size, MaxDataSize())
+		}
+		if i > 0 && !c.inOrder(ln.Cells[i-1].key, k) {
+			c.report(page, "key %d at cell %d is not after key %d", k, i, ln.Cells[i-1].key)
+		}
+		if low != nil && k < *low {
+			c.report(page, "key %d is smaller than the separator %d on its left", k, *low)
+		}
+		if high != nil && (k > *high || (k == *high && c.bt.KeyMode == KeyModeUnique)) {
+			c.report(page, "key %d is not smaller than the separator %d on its right", k, *high)
+		}
+	}
+	return 0
+}
+
+func (c *checker) checkInternal(in *InternalNode, low, high *key) int {
+	page := in.Header.Page
+
+	if in.Header.Parent != 0 && in.Header.Typ != TypeInternal {
+		c.report(page, "internal node has type %s", in.Header.Typ)
+	}
+	if in.Header.NumCell == 0 {
+		c.report(page, "internal node without cells")
+		return -1
+	}
+	if uint32(in.Header.NumCell) > maxInternalNodeNumCell() {
+		c.report(page, "%d cells, more than the maximum %d", in.Header.NumCell, maxInternalNodeNumCell())
+	}
+	if in.Header.Parent != 0 && uint32(in.Header.NumCell) < minInternalNodeNumCell() {
+		c.report(page, "%d cells, less than the minimum %d", in.Header.NumCell, minInternalNodeNumCell())
+	}
+	for i := 1; i < int(in.Header.NumCell); i++ {
+		if in.Cells[i-1].right != in.Cells[i].left {
+			c.report(page, "cell %d points right to %d, but cell %d points left to %d", i-1, in.Cells[i-1].right, i, in.Cells[i].left)
+		}
+	}
+
+	keys := in.keys()
+	for i, k := range keys {
+		if i > 0 && k < keys[i-1] {
+			c.report(page, "separator %d at cell %d is smaller than %d", k, i, keys[i-1])
+		}
+		if (low != nil && k < *low) || (high != nil && k > *high) {
+			c.report(page, "separator %d is out of the range of the node", k)
+		}
+	}
+
+	height := -1
+	for i, child := range in.children() {
+		childLow, childHigh := low, high
+		if i > 0 {
+			childLow = &keys[i-1]
+		}
+		if i < len(keys) {
+			childHigh = &keys[i]
+		}
+		h := c.checkNode(child, page, childLow, childHigh)
+		if h < 0 {
+			continue
+		}
+		if height >= 0 && h != height {
+			c.report(child, "leaves under this node are %d levels down, %d under its siblings", h, height)
+		}
+		height = h
+	}
+	if height < 0 {
+		return -1
+	}
+	return height + 1
+}
+
+// Keys in a node must increase, or not decrease with duplicate keys
+func (c *checker) inOrder(prev key, next key) bool {
+	if c.bt.KeyMode == KeyModeDuplicate {
+		return prev <= next
+	}
+	return prev < next
+}
+
+// The Next chain from First must visit every leaf exactly once, in key order
+func (c *checker) checkLeafChain() {
+	if len(c.leaves) > 0 && c.bt.First != c.leaves[0] {
+		c.report(0, "first leaf is %d, expected %d", c.bt.First, c.leaves[0])
+	}
+
+	seen := map[PageNum]bool{}
+	page := c.bt.First
+	for i := 0; page != 0; i++ {
+		if seen[page] {
+			c.report(page, "the Next chain visits the leaf again")
+			return
+		}
+		seen[page] = true
+		if i >= len(c.leaves) {
+			c.report(page, "the Next chain goes past the last leaf")
+			return
+		}
+		if page != c.leaves[i] {
+			c.report(page, "leaf %d of the Next chain, expected %d", i, c.leaves[i])
+			return
+		}
+		ln, err := c.bt.readLeaf(page)
+		if err != nil {
+			c.report(page, "the Next chain points to a page which is not a leaf -- %s", err)
+			return
+		}
+		page = ln.Header.Next
+	}
+	if len(seen) < len(c.leaves) {
+		c.report(c.leaves[len(seen)], "the Next chain ends before this leaf, after %d of %d leaves", len(seen), len(c.leaves))
+	}
+}
+
+// The freelist from the tree page must only hold free pages, none of them
+// used by the tree, and NumFree of them
+func (c *checker) checkFreelist() {
+	page := c.bt.Free
+	for page != 0 {
+		if uint32(page) >= c.bt.pager.NumPages() {
+			c.report(page, "free page is out of the file with %d pages", c.bt.pager.NumPages())
+			break
+		}
+		if c.free[page] {
+			c.report(page, "the freelist visits the page again")
+			break
+		}
+		c.free[page] = true
+		if c.visited[page] {
+			c.report(page, "free page is a node of the tree")
+		}
+		bytes, err := c.bt.pager.ReadPage(uint32(page))
+		if err != nil {
+			c.report(page, "%s", err)
+			break
+		}
+		next, err := deserializeFreePage(bytes)
+		if err != nil {
+			c.report(page, "%s", err)
+			break
+		}
+		page = next
+	}
+	if uint32(len(c.free)) != c.bt.NumFree {
+		c.report(0, "NumFree is %d, found %d free pages", c.bt.NumFree, len(c.free))
+	}
+}
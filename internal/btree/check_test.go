@@ -0,0 +1,101 @@
+package btree
+
+import (
+	"strings"
+	"testing"
+)
+
+func hasViolation(violations []Violation, page PageNum, message string) bool {
+	for _, v := range violations {
+		if v.Page == page && strings.Contains(v.Message, message) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheck(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	if violations := bt.Check(); len(violations) != 0 {
+		t.Fatalf("Check empty tree: %v", violations)
+	}
+
+	var keys []int
+	for i := 1; i <= 50; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+	if violations := bt.Check(); len(violations) != 0 {
+		t.Fatalf("Check sound tree: %v", violations)
+	}
+
+	// a wrong parent pointer
+	leaf := mustReadNode(t, bt, bt.First).(*LeafNode)
+	parent := leaf.Header.Parent
+	bt.setParent(leaf.Header.Page, bt.Root+100)
+	if !hasViolation(bt.Check(), leaf.Header.Page, "parent is") {
+		t.Fatalf("Check didn't find the wrong parent of page %d: %v", leaf.Header.Page, bt.Check())
+	}
+	bt.setParent(leaf.Header.Page, parent)
+
+	// a leaf skipped by the Next chain
+	leaf = mustReadNode(t, bt, bt.First).(*LeafNode)
+	next := leaf.Header.Next
+	leaf.Header.Next = mustReadNode(t, bt, next).header().Next
+	leaf.save()
+	if !hasViolation(bt.Check(), leaf.Header.Next, "of the Next chain") {
+		t.Fatalf("Check didn't find the broken Next chain: %v", bt.Check())
+	}
+	leaf.Header.Next = next
+	leaf.save()
+
+	// keys out of order
+	leaf = mustReadNode(t, bt, bt.First).(*LeafNode)
+	leaf.Cells[0].key, leaf.Cells[1].key = leaf.Cells[1].key, leaf.Cells[0].key
+	leaf.save()
+	if !hasViolation(bt.Check(), leaf.Header.Page, "is not after key") {
+		t.Fatalf("Check didn't find keys out of order: %v", bt.Check())
+	}
+	leaf.Cells[0].key, leaf.Cells[1].key = leaf.Cells[1].key, leaf.Cells[0].key
+	leaf.save()
+
+	// a separator larger than the keys on its right
+	root := mustReadNode(t, bt, bt.Root).(*InternalNode)
+	root.Cells[0].key += 100
+	root.save()
+	if violations := bt.Check(); len(violations) == 0 {
+		t.Fatal("Check didn't find the wrong separator")
+	}
+	root.Cells[0].key -= 100
+	root.save()
+
+	// a wrong node count
+	bt.NumNode++
+	if !hasViolation(bt.Check(), 0, "NumNode") {
+		t.Fatalf("Check didn't find the wrong node count: %v", bt.Check())
+	}
+	bt.NumNode--
+
+	// a page lost from the tree and the freelist, then a node in the freelist
+	for i := 1; i <= 30; i++ {
+		mustDelete(t, bt, uint32(i))
+	}
+	if bt.NumFree == 0 {
+		t.Fatal("No free page after deleting")
+	}
+	free, numFree := bt.Free, bt.NumFree
+	bt.Free, bt.NumFree = 0, 0
+	if !hasViolation(bt.Check(), free, "neither a node") {
+		t.Fatalf("Check didn't find the lost page %d: %v", free, bt.Check())
+	}
+	bt.Free, bt.NumFree = bt.First, 1
+	if !hasViolation(bt.Check(), bt.First, "free page is a node") {
+		t.Fatalf("Check didn't find the node in the freelist: %v", bt.Check())
+	}
+	bt.Free, bt.NumFree = free, numFree
+
+	if violations := bt.Check(); len(violations) != 0 {
+		t.Fatalf("Check restored tree: %v", violations)
+	}
+}
@@ -0,0 +1,132 @@
+package btree
+
+// Cursor iterates the cells in key order, it walks the cells of a leaf
+// then follows the Next pointer to the following leaf.
+// A failed page read stops the cursor, Valid returns false and Err the error.
+type Cursor struct {
+	btree *BTree
+	leaf  *LeafNode
+	index int // cell index in leaf
+	err   error
+}
+
+// Returns a cursor not pointing to any cell yet, move it with First, Last or Seek
+func (bt *BTree) Cursor() *Cursor {
+	return &Cursor{btree: bt}
+}
+
+// Returns a cursor at the first cell of the tree
+func (bt *BTree) FullScan() *Cursor {
+	c := bt.Cursor()
+	c.First()
+	return c
+}
+
+// Move to the first cell of the leftmost leaf
+func (c *Cursor) First() {
+	c.reset()
+	if c.btree.NumNode == 0 {
+		return
+	}
+	c.leaf, c.err = c.btree.readLeaf(c.btree.First)
+	c.skipEmptyLeaves()
+}
+
+// Move to the last cell of the rightmost leaf
+func (c *Cursor) Last() {
+	c.reset()
+	if c.btree.NumNode == 0 {
+		return
+	}
+	c.leaf, c.err = c.btree.lastLeaf(c.btree.Root)
+	if c.err != nil {
+		return
+	}
+	c.index = int(c.leaf.Header.NumCell) - 1
+	c.skipEmptyLeavesBackward()
+}
+
+// Move to the first cell with a key >= k
+func (c *Cursor) Seek(k uint32) {
+	c.reset()
+	if c.btree.NumNode == 0 {
+		return
+	}
+	c.leaf, c.err = c.btree.lowerBoundLeaf(key(k))
+	if c.err != nil {
+		return
+	}
+	c.index = int(c.leaf.Header.NumCell)
+	for i := 0; i < int(c.leaf.Header.NumCell); i++ {
+		if c.leaf.Cells[i].key >= key(k) {
+			c.index = i
+			break
+		}
+	}
+	// every key in the leaf is smaller, the next key is the first one of the next leaf
+	c.skipEmptyLeaves()
+}
+
+// The cursor points to a cell, false after moving past the last cell
+func (c *Cursor) Valid() bool {
+	return c.err == nil && c.leaf != nil && c.index < int(c.leaf.Header.NumCell)
+}
+
+// The error that stopped the cursor, nil if it reached the end normally
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Move to the next cell in key order
+func (c *Cursor) Next() {
+	if !c.Valid() {
+		return
+	}
+	c.index++
+	c.skipEmptyLeaves()
+}
+
+// Move to the previous cell in key order
+func (c *Cursor) Prev() {
+	if !c.Valid() {
+		return
+	}
+	c.index--
+	c.skipEmptyLeavesBackward()
+}
+
+func (c *Cursor) Key() uint32 {
+	return uint32(c.leaf.Cells[c.index].key)
+}
+
+func (c *Cursor) Value() []byte {
+	return c.leaf.Cells[c.index].data
+}
+
+func (c *Cursor) reset() {
+	c.leaf = nil
+	c.index = 0
+	c.err = nil
+}
+
+// Follow the Next pointers while the cursor is past the last cell of its leaf
+func (c *Cursor) skipEmptyLeaves() {
+	for c.err == nil && c.leaf != nil && c.index >= int(c.leaf.Header.NumCell) {
+		if c.leaf.Header.Next == 0 {
+			c.leaf = nil
+			return
+		}
+		c.leaf, c.err = c.btree.readLeaf(c.leaf.Header.Next)
+		c.index = 0
+	}
+}
+
+// Go to the previous leaves while the cursor is before the first cell of its leaf
+func (c *Cursor) skipEmptyLeavesBackward() {
+	for c.err == nil && c.leaf != nil && c.index < 0 {
+		c.leaf, c.err = c.btree.prevLeaf(c.leaf)
+		if c.leaf != nil {
+			c.index = int(c.leaf.Header.NumCell) - 1
+		}
+	}
+}
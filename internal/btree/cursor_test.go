@@ -0,0 +1,90 @@
+package btree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFullScan(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	if bt.FullScan().Valid() {
+		t.Fatal("Full scan of an empty tree is not empty")
+	}
+
+	keys := rand.New(rand.NewSource(2)).Perm(200)
+	for i := range keys {
+		keys[i]++
+	}
+	insertRows(t, bt, keys)
+
+	var expected uint32 = 1
+	for c := bt.FullScan(); c.Valid(); c.Next() {
+		if c.Key() != expected {
+			t.Fatalf("Full scan: found key %d, expected %d", c.Key(), expected)
+		}
+		if len(c.Value()) != 520 {
+			t.Fatalf("Full scan: wrong value size %d for key %d", len(c.Value()), c.Key())
+		}
+		expected++
+	}
+	if expected != 201 {
+		t.Fatalf("Full scan: found %d keys, expected %d", expected-1, 200)
+	}
+}
+
+func TestCursorSeekAndPrev(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	c := bt.Cursor()
+	if c.Valid() {
+		t.Fatal("Cursor: new cursor is valid before moving")
+	}
+	c.Seek(1)
+	if c.Valid() {
+		t.Fatal("Cursor: seek in an empty tree is valid")
+	}
+
+	var keys []int
+	for i := 10; i <= 500; i += 10 {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+
+	c.Seek(250)
+	if !c.Valid() || c.Key() != 250 {
+		t.Fatalf("Cursor: seek to existing key 250, found valid %v", c.Valid())
+	}
+	c.Seek(255)
+	if !c.Valid() || c.Key() != 260 {
+		t.Fatalf("Cursor: seek to missing key 255 should stop at 260, found %d", c.Key())
+	}
+	c.Seek(501)
+	if c.Valid() {
+		t.Fatalf("Cursor: seek past the last key is valid at %d", c.Key())
+	}
+
+	// walk back from the last key to the first one
+	c.Last()
+	var expected uint32 = 500
+	for ; c.Valid(); c.Prev() {
+		if c.Key() != expected {
+			t.Fatalf("Cursor: prev found key %d, expected %d", c.Key(), expected)
+		}
+		expected -= 10
+	}
+	if expected != 0 {
+		t.Fatalf("Cursor: prev stopped before the first key, at %d", expected+10)
+	}
+
+	// prev and next cross leaf boundaries back and forth
+	c.Seek(10)
+	for i := 0; i < 20; i++ {
+		c.Next()
+	}
+	c.Prev()
+	c.Next()
+	if c.Key() != 210 {
+		t.Fatalf("Cursor: found key %d after moving back and forth, expected %d", c.Key(), 210)
+	}
+}
@@ -0,0 +1,93 @@
+package btree
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Pages of dropped nodes are kept in a linked list anchored in the tree page,
+// each free page stores the next one after its magic number and checksum:
+// +-------+----------+-----------+----------------+
+// | magic | checksum | next free |     unused     |
+// |  2B   |    4B    |    4B     |                |
+// +-------+----------+-----------+----------------+
+// New nodes take the head of the list before extending the file.
+
+func serializeFreePage(next PageNum) []byte {
+	page := makeNodePage(constants.MagicNumberFree)
+	binary.LittleEndian.PutUint32(page[constants.PageHeaderSize:], uint32(next))
+	return page
+}
+
+// Returns the next free page stored in a free page
+func deserializeFreePage(page []byte) (PageNum, error) {
+	magicNumber := hex.EncodeToString(page[:constants.MagicNumberSize])
+	if magicNumber != constants.MagicNumberFree {
+		return 0, fmt.Errorf("deserializing free page: invalid magic number %s, expected %s", magicNumber, constants.MagicNumberFree)
+	}
+	return PageNum(binary.LittleEndian.Uint32(page[constants.PageHeaderSize:])), nil
+}
+
+// Get a page for a new node, from the freelist of the file if it's not empty
+func (bt *BTree) allocPage() (PageNum, error) {
+	file := bt.file
+	if file.Free == 0 {
+		return PageNum(bt.pager.Allocate()), nil
+	}
+	page := file.Free
+	bytes, err := bt.pager.ReadPage(uint32(page))
+	if err != nil {
+		return 0, err
+	}
+	next, err := deserializeFreePage(bytes)
+	if err != nil {
+		return 0, fmt.Errorf("allocating page %d from the freelist: %w", page, err)
+	}
+	file.Free = next
+	file.NumFree--
+	return page, nil
+}
+
+// The node was merged and removed from the tree, its page goes to the
+// head of the freelist. The node must not be saved after.
+func (bt *BTree) dropNode(page PageNum) error {
+	file := bt.file
+	if err := bt.pager.WritePage(uint32(page), serializeFreePage(file.Free)); err != nil {
+		return err
+	}
+	file.Free = page
+	file.NumFree++
+	bt.NumNode--
+	return nil
+}
+
+// Drop every node of the tree to the freelist, leaving an empty tree
+func (bt *BTree) Drop() error {
+	if bt.Root != 0 {
+		if err := bt.dropSubtree(bt.Root); err != nil {
+			return err
+		}
+	}
+	bt.Root = 0
+	bt.First = 0
+	return bt.save()
+}
+
+// Drop the node on the page and every node below it
+func (bt *BTree) dropSubtree(page PageNum) error {
+	n, err := bt.readNode(page)
+	if err != nil {
+		return err
+	}
+	if in, ok := n.(*InternalNode); ok {
+		for _, child := range in.children() {
+			if err := bt.dropSubtree(child); err != nil {
+				return err
+			}
+		}
+	}
+	return bt.dropNode(page)
+}
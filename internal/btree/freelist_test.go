@@ -0,0 +1,99 @@
+package btree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/tomial/go-db/internal/constants"
+	"github.com/tomial/go-db/internal/pager"
+)
+
+func TestFreePageSerialization(t *testing.T) {
+	next, err := deserializeFreePage(serializeFreePage(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 42 {
+		t.Fatalf("Free page: found next page %d, expected 42", next)
+	}
+
+	if _, err := deserializeFreePage(makeNodePage(constants.MagicNumberLeaf)); err == nil {
+		t.Fatal("Free page: failed to capture the magic number of a leaf")
+	}
+}
+
+func TestFreelistReuse(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	var keys []int
+	for i := 1; i <= 100; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+	numPages := bt.pager.NumPages()
+
+	for i := 1; i <= 80; i++ {
+		mustDelete(t, bt, uint32(i))
+	}
+	verifyTree(t, bt)
+	// every dropped node is in the freelist, the file doesn't shrink
+	if bt.NumFree == 0 || bt.NumNode+bt.NumFree+1 != numPages {
+		t.Fatalf("Found %d nodes and %d free pages in a file with %d pages", bt.NumNode, bt.NumFree, numPages)
+	}
+
+	// the freelist survives reopening the file
+	if err := bt.pager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pager.Init(bt.pager.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(p, KeyModeUnique)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Free != bt.Free || reopened.NumFree != bt.NumFree {
+		t.Fatalf("Reopened freelist %d with %d pages, expected %d with %d", reopened.Free, reopened.NumFree, bt.Free, bt.NumFree)
+	}
+
+	// splits take the free pages before extending the file,
+	// an insert takes at most a page per level and one for a new root
+	for i := 101; reopened.NumFree > 0; i++ {
+		enough := reopened.NumFree > uint32(mustReadNode(t, reopened, reopened.Root).header().Height)+1
+		insertRows(t, reopened, []int{i})
+		if enough && reopened.pager.NumPages() != numPages {
+			t.Fatalf("Insert %d extended the file to %d pages with %d free pages left", i, reopened.pager.NumPages(), reopened.NumFree)
+		}
+	}
+	verifyTree(t, reopened)
+}
+
+func TestDrop(t *testing.T) {
+	file := openTestTree(t, KeyModeUnique)
+	kept := file.OpenTree(Header{KeyMode: KeyModeUnique}, func(Header) error { return nil })
+	dropped := file.OpenTree(Header{KeyMode: KeyModeUnique}, func(Header) error { return nil })
+	insertRows(t, kept, rand.Perm(50))
+	insertRows(t, dropped, rand.Perm(100))
+	numNode := dropped.NumNode
+
+	if err := dropped.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if dropped.Root != 0 || dropped.First != 0 || dropped.NumNode != 0 {
+		t.Fatalf("Dropped tree has root %d, first %d, %d nodes", dropped.Root, dropped.First, dropped.NumNode)
+	}
+	if file.NumFree != numNode {
+		t.Fatalf("%d free pages after dropping %d nodes", file.NumFree, numNode)
+	}
+	if violations := file.Check(kept); len(violations) != 0 {
+		t.Fatalf("Check file after drop: %v", violations)
+	}
+	verifyTree(t, kept)
+
+	// the pages of the dropped tree are reused
+	numPages := file.pager.NumPages()
+	insertRows(t, dropped, []int{1, 2, 3})
+	if file.pager.NumPages() != numPages || file.NumFree != numNode-1 {
+		t.Fatalf("%d pages and %d free pages after reusing a dropped tree", file.pager.NumPages(), file.NumFree)
+	}
+}
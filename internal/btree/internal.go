@@ -52,27 +52,40 @@ func maxInternalNodeNumCell() uint32 {
 	return 3
 }
 
-func (in *InternalNode) find(key key) (found bool, data []byte) {
-	if in.btree == nil {
-		in.btree = NewBtree()
-	}
-	for index, cell := range in.Cells {
-		// The last cell
-		if index == int(in.Header.NumCell)-1 && key >= cell.key {
-			return in.btree.readNode(cell.right).find(key)
+// Minimum amount of cells of a non-root internal node
+func minInternalNodeNumCell() uint32 {
+	return maxInternalNodeNumCell() / 2
+}
+
+func (in *InternalNode) header() *nodeHeader {
+	return in.Header
+}
+
+// Child page to descend into: the left of the first cell with a larger key,
+// keys equal to the cell key go to the right
+func (in *InternalNode) childFor(key key) PageNum {
+	for index := 0; index < int(in.Header.NumCell); index++ {
+		if key < in.Cells[index].key {
+			return in.Cells[index].left
 		}
+	}
+	return in.Cells[in.Header.NumCell-1].right
+}
 
-		if cell.key >= key {
-			return in.btree.readNode(cell.left).find(key)
+// Leftmost child page that may have the key, keys equal to the cell key go to the left
+func (in *InternalNode) lowerBoundChild(key key) PageNum {
+	for index := 0; index < int(in.Header.NumCell); index++ {
+		if key <= in.Cells[index].key {
+			return in.Cells[index].left
 		}
 	}
-	return false, nil
+	return in.Cells[in.Header.NumCell-1].right
 }
 
 func (in *InternalNode) serialize() []byte {
 	page := makeNodePage(constants.MagicNumberInternal)
 
-	pos := constants.MagicNumberSize
+	pos := constants.PageHeaderSize
 	headerBytes := in.Header.serialize()
 	copy(page[pos:pos+nodeHeaderSize()], headerBytes)
 	pos = util.AdvanceCursor(pos, nodeHeaderSize())
@@ -96,7 +109,7 @@ func (in *InternalNode) deserialize(bytes []byte) error {
 		return fmt.Errorf("deserializing internal node: invalid magic number for internal node -- %s, expected %s", magicNumber, constants.MagicNumberInternal)
 	}
 
-	pos := constants.MagicNumberSize
+	pos := constants.PageHeaderSize
 	err := in.Header.deserialize(bytes[pos : pos+nodeHeaderSize()])
 	if err != nil {
 		return err
@@ -187,7 +200,7 @@ func (in *InternalNode) deserializeCells(bytes []byte) error {
 
 func (in *InternalNode) syncNeighborPointer(index int) {
 	// Sync if there's a right cell
-	if uint8(index) < in.Header.NumCell-1 {
+	if uint16(index) < in.Header.NumCell-1 {
 		in.Cells[index+1].left = in.Cells[index].right
 	}
 	// Sync the left cell
@@ -196,113 +209,112 @@ func (in *InternalNode) syncNeighborPointer(index int) {
 	}
 }
 
-func (in *InternalNode) searchLeaf(key key) *LeafNode {
-	for index, cell := range in.Cells {
-		// The last cell
-		if uint8(index) == in.Header.NumCell-1 && key > cell.key {
-			if in.btree == nil {
-				in.btree = NewBtree()
-			}
-			return in.btree.readNode(cell.right).searchLeaf(key)
+// Child pages in key order, the left of every cell and the right of the last one
+func (in *InternalNode) children() []PageNum {
+	if in.Header.NumCell == 0 {
+		return nil
+	}
+	pages := make([]PageNum, 0, in.Header.NumCell+1)
+	for i := 0; i < int(in.Header.NumCell); i++ {
+		pages = append(pages, in.Cells[i].left)
+	}
+	return append(pages, in.Cells[in.Header.NumCell-1].right)
+}
+
+func (in *InternalNode) keys() []key {
+	keys := make([]key, in.Header.NumCell)
+	for i := range keys {
+		keys[i] = in.Cells[i].key
+	}
+	return keys
+}
+
+// Rebuild the cells from keys and children, len(children) should be len(keys) + 1
+func (in *InternalNode) setEntries(keys []key, children []PageNum) {
+	in.Cells = make([]*internalCell, maxInternalNodeNumCell()+1)
+	for i, k := range keys {
+		in.Cells[i] = &internalCell{
+			key:   k,
+			left:  children[i],
+			right: children[i+1],
 		}
+	}
+	in.Header.NumCell = uint16(len(keys))
+}
 
-		if cell.key >= key {
-			if in.btree == nil {
-				in.btree = NewBtree()
-			}
-			return in.btree.readNode(cell.left).searchLeaf(key)
+// Position of the child page in children(), -1 if it's not a child of the node
+func (in *InternalNode) childIndex(page PageNum) int {
+	for index, child := range in.children() {
+		if child == page {
+			return index
 		}
 	}
-	return nil
+	return -1
 }
 
-func (in *InternalNode) split() *InternalNode {
-	if in.btree == nil {
-		in.btree = NewBtree()
+func (in *InternalNode) searchLeaf(key key) (*LeafNode, error) {
+	child, err := in.btree.readNode(in.childFor(key))
+	if err != nil {
+		return nil, err
 	}
+	return child.searchLeaf(key)
+}
+
+// Move the cells after the middle one to a new right node, the middle key goes to the parent.
+// Both nodes are saved here, the caller should not save in again.
+func (in *InternalNode) split() error {
+	bt := in.btree
 
 	// spawn right node
 	right := initEmptyInternalNode()
-	right.Header.CellSize = in.Header.CellSize
-	right.Header.Page = PageNum(in.btree.NumNode + 1)
+	right.btree = bt
+	page, err := bt.allocPage()
+	if err != nil {
+		return err
+	}
+	right.Header.Page = page
 	right.Header.Parent = in.Header.Parent
-	in.btree.NumNode++
-	in.Header.Next = right.Header.Page
-	right.Header.Typ = TypeInternal
+	right.Header.Height = in.Header.Height
+	bt.NumNode++
 	right.Cells = make([]*internalCell, maxInternalNodeNumCell()+1)
 
 	middle := in.Header.NumCell / 2
 	bubbleKey := in.Cells[middle].key
 
 	// the middle cell goes to parent node
-	copy(right.Cells, in.Cells[middle+1:])
+	copy(right.Cells, in.Cells[middle+1:in.Header.NumCell])
 	right.Header.NumCell = in.Header.NumCell - middle - 1 // minus nodes after middle and the one bubbled into parent
-	for index := range in.Cells[middle:] {
+	for index := middle; index < in.Header.NumCell; index++ {
 		in.Cells[index] = nil
-		in.Header.NumCell--
 	}
+	in.Header.NumCell = middle
 
-	if in.Header.Parent != 0 {
-		parentNode := in.btree.readNode(in.Header.Parent)
-		bubbleCell := &internalCell{
-			key:   bubbleKey,
-			left:  in.Header.Page,
-			right: right.Header.Page,
-		}
-		bubbleBytes, err := bubbleCell.serialize()
-		if err != nil {
-			log.Fatal(err)
-		}
-		parentNode.saveCell(bubbleKey, bubbleBytes)
-	} else {
-		// the bubble key goes into new root node
-		if in.Header.Typ == TypeRoot {
-			in.Header.Typ = TypeInternal
-		}
-		newRoot := initEmptyInternalNode()
-		newRoot.btree = in.btree
-
-		newRoot.Header.Typ = TypeRoot
-		newRoot.Header.CellSize = internalNodeCellSize()
-		newRoot.Header.Page = PageNum(in.btree.NumNode) + 1
-		in.btree.Root = newRoot.Header.Page
-		in.btree.NumNode++
-		newRoot.Header.Parent = 0
-		in.Header.Parent = newRoot.Header.Page
-		right.Header.Parent = newRoot.Header.Page
-		right.Header.Parent = newRoot.Header.Page
-
-		newRoot.Cells = make([]*internalCell, maxInternalNodeNumCell()+1)
-		newRoot.Cells[0] = &internalCell{
-			key:   bubbleKey,
-			left:  in.Header.Page,
-			right: right.Header.Page,
+	// children moved to the right node point to it now
+	for _, child := range right.children() {
+		if err := bt.setParent(child, right.Header.Page); err != nil {
+			return err
 		}
-		newRoot.Header.NumCell++
-		newRoot.btree.save()
-		newRoot.save()
 	}
 
-	return right
+	return bt.insertIntoParent(in, bubbleKey, right)
 }
 
-func (in *InternalNode) saveCell(key key, data []byte) {
+// Insert a serialized cell, the left page of the cell must be a child of the node already
+// and the right page is the new child that goes after it
+func (in *InternalNode) saveCell(key key, data []byte) error {
 	ic := &internalCell{}
 	err := ic.deserialize(data)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	pos := 0
-	for index, cell := range in.Cells {
-		if cell == nil || in.Cells[index].key > key {
-			pos = index
-			break
-		}
+	pos := in.childIndex(ic.left)
+	if pos < 0 {
+		return fmt.Errorf("internal node insert: page %d is not a child of node %d", ic.left, in.Header.Page)
 	}
 
 	if in.Cells[pos] != nil {
-		copy(in.Cells[pos+1:], in.Cells[pos:])
+		copy(in.Cells[pos+1:], in.Cells[pos:in.Header.NumCell])
 	}
 
 	in.Cells[pos] = ic
@@ -310,24 +322,127 @@ func (in *InternalNode) saveCell(key key, data []byte) {
 	in.syncNeighborPointer(pos)
 
 	// add cell to internal node before split
-	if in.Header.NumCell == uint8(maxInternalNodeNumCell()+1) {
-		right := in.split()
-		right.save()
+	if in.Header.NumCell == uint16(maxInternalNodeNumCell()+1) {
+		return in.split()
 	}
-	in.save()
+	return in.save()
+}
 
+// Remove the child at index of children() and the key on its left,
+// used after the child was merged into its left sibling
+func (in *InternalNode) removeChild(index int) error {
+	keys, children := in.keys(), in.children()
+	keys = append(keys[:index-1], keys[index:]...)
+	children = append(children[:index], children[index+1:]...)
+	return in.rebalance(keys, children)
 }
 
-func (in *InternalNode) save() error {
-	if in.btree == nil {
-		in.btree = NewBtree()
+// Save the node with the new entries, fixing an underflow like LeafNode.rebalance.
+// Entries are passed separately because an underflow node may be left with
+// a single child, which can't be represented by cells.
+func (in *InternalNode) rebalance(keys []key, children []PageNum) error {
+	bt := in.btree
+
+	if in.Header.Parent == 0 {
+		if len(keys) == 0 {
+			// the root has a single child left, which becomes the new root
+			return bt.collapseRoot(in, children[0])
+		}
+		in.setEntries(keys, children)
+		return in.save()
+	}
+
+	if uint32(len(keys)) >= minInternalNodeNumCell() {
+		in.setEntries(keys, children)
+		return in.save()
+	}
+
+	parent, err := bt.readInternal(in.Header.Parent)
+	if err != nil {
+		return err
+	}
+	index := parent.childIndex(in.Header.Page)
+	parentKeys, parentChildren := parent.keys(), parent.children()
+
+	if index > 0 {
+		left, err := bt.readInternal(parentChildren[index-1])
+		if err != nil {
+			return err
+		}
+		leftKeys, leftChildren := left.keys(), left.children()
+		if uint32(len(leftKeys)+1+len(keys)) <= maxInternalNodeNumCell() {
+			// merge into the left node through the parent key, then drop this one
+			leftKeys = append(append(leftKeys, parentKeys[index-1]), keys...)
+			leftChildren = append(leftChildren, children...)
+			for _, child := range children {
+				if err := bt.setParent(child, left.Header.Page); err != nil {
+					return err
+				}
+			}
+			left.setEntries(leftKeys, leftChildren)
+			if err := left.save(); err != nil {
+				return err
+			}
+			if err := bt.dropNode(in.Header.Page); err != nil {
+				return err
+			}
+			return parent.removeChild(index)
+		}
+		// rotate the last child of the left node through the parent
+		moved := leftChildren[len(leftChildren)-1]
+		keys = append([]key{parentKeys[index-1]}, keys...)
+		children = append([]PageNum{moved}, children...)
+		parentKeys[index-1] = leftKeys[len(leftKeys)-1]
+		left.setEntries(leftKeys[:len(leftKeys)-1], leftChildren[:len(leftChildren)-1])
+		in.setEntries(keys, children)
+		parent.setEntries(parentKeys, parentChildren)
+		if err := bt.setParent(moved, in.Header.Page); err != nil {
+			return err
+		}
+		return saveNodes(left, in, parent)
+	}
+
+	right, err := bt.readInternal(parentChildren[index+1])
+	if err != nil {
+		return err
+	}
+	rightKeys, rightChildren := right.keys(), right.children()
+	if uint32(len(keys)+1+len(rightKeys)) <= maxInternalNodeNumCell() {
+		// merge the right node into this one through the parent key, then drop it
+		keys = append(append(keys, parentKeys[index]), rightKeys...)
+		children = append(children, rightChildren...)
+		for _, child := range rightChildren {
+			if err := bt.setParent(child, in.Header.Page); err != nil {
+				return err
+			}
+		}
+		in.setEntries(keys, children)
+		if err := in.save(); err != nil {
+			return err
+		}
+		if err := bt.dropNode(right.Header.Page); err != nil {
+			return err
+		}
+		return parent.removeChild(index + 1)
+	}
+	// rotate the first child of the right node through the parent
+	moved := rightChildren[0]
+	keys = append(keys, parentKeys[index])
+	children = append(children, moved)
+	parentKeys[index] = rightKeys[0]
+	right.setEntries(rightKeys[1:], rightChildren[1:])
+	in.setEntries(keys, children)
+	parent.setEntries(parentKeys, parentChildren)
+	if err := bt.setParent(moved, in.Header.Page); err != nil {
+		return err
 	}
+	return saveNodes(right, in, parent)
+}
 
+func (in *InternalNode) save() error {
 	if in.Header.Page == 0 {
 		return fmt.Errorf("saving internal node: invalid node page: %d", in.Header.Page)
 	}
 
-	in.btree.pager.WritePage(uint32(in.Header.Page), in.serialize())
-
-	return nil
+	return in.btree.pager.WritePage(uint32(in.Header.Page), in.serialize())
 }
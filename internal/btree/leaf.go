@@ -3,7 +3,6 @@ package btree
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"log"
 
@@ -11,11 +10,29 @@ import (
 	"github.com/tomial/go-db/internal/util"
 )
 
+// Leaves are slotted pages, the cells have variable sizes. A pointer array
+// after the node header holds the offset of every cell in key order, the
+// cells are packed from the end of the page towards the pointers, the space
+// between them is free. Cells are packed again every time the leaf is saved.
+// +-------------+---------+---------+-----+------------+--------+--------+
+// | node header | pointer | pointer | ... | free space | cell 1 | cell 0 |
+// +-------------+---------+---------+-----+------------+--------+--------+
+// pointer: offset of the cell in the node body 2B
+// cell:    key 4B, data size 2B, data
+
+const leafPointerSize = 2
+const leafCellHeaderSize = constants.BTreeKeySize + 2
+
 type leafCell struct {
 	key  key
 	data []byte
 }
 
+// Bytes taken by the cell in the node body, with its pointer
+func (cell *leafCell) size() uint32 {
+	return leafPointerSize + leafCellHeaderSize + uint32(len(cell.data))
+}
+
 // leaf node
 type LeafNode struct {
 	btree  *BTree
@@ -33,121 +50,109 @@ func initEmptyRootNode() *LeafNode {
 	return ln
 }
 
-func (ln *LeafNode) maxLeafNodeNumCell() uint32 {
-	return nodeBodySize() / ln.Header.CellSize
+// Bytes of the node body taken by the cells and their pointers
+func (ln *LeafNode) usedBytes() uint32 {
+	var used uint32
+	for _, cell := range ln.Cells {
+		used += cell.size()
+	}
+	return used
+}
+
+// Free bytes of the node body, negative when the cells don't fit in the page
+// and the leaf has to split before it's saved
+func (ln *LeafNode) freeBytes() int {
+	return int(nodeBodySize()) - int(ln.usedBytes())
 }
 
-func (ln *LeafNode) SetCellSize(dataSize uint32) {
-	ln.Header.CellSize = constants.BTreeKeySize + dataSize
+// A non-root leaf with fewer used bytes borrows from or merges with a sibling.
+// Cells are at most a quarter of the body, so the halves of a split leaf and
+// a leaf after borrowing are above it.
+func minLeafBytes() uint32 {
+	return nodeBodySize() / 4
 }
 
-// Find the entry in leaf node
-func (ln *LeafNode) find(key key) (found bool, data []byte) {
-	if len(ln.Cells) == 0 {
-		return false, nil
-	} else {
-		for _, cell := range ln.Cells {
-			if cell == nil {
-				return false, nil
-			}
-			if key == cell.key {
-				return true, cell.data
-			}
+// Largest size of the data of a key, a leaf holds at least 4 cells
+func MaxDataSize() uint32 {
+	return nodeBodySize()/4 - leafPointerSize - leafCellHeaderSize
+}
+
+func (ln *LeafNode) header() *nodeHeader {
+	return ln.Header
+}
+
+// index of the cell with the key, -1 if it's not in the node
+func (ln *LeafNode) cellIndex(key key) int {
+	for i := 0; i < int(ln.Header.NumCell); i++ {
+		if ln.Cells[i].key == key {
+			return i
 		}
 	}
-	return false, nil
+	return -1
 }
 
 // the caller leaf node is the target, return itself
-func (ln *LeafNode) searchLeaf(key key) *LeafNode {
-	return ln
+func (ln *LeafNode) searchLeaf(key key) (*LeafNode, error) {
+	return ln, nil
+}
+
+func (ln *LeafNode) insertCellAt(pos int, cell *leafCell) {
+	ln.Cells = append(ln.Cells, nil)
+	copy(ln.Cells[pos+1:], ln.Cells[pos:])
+	ln.Cells[pos] = cell
+	ln.Header.NumCell++
+}
+
+func (ln *LeafNode) removeCellAt(pos int) *leafCell {
+	cell := ln.Cells[pos]
+	ln.Cells = append(ln.Cells[:pos], ln.Cells[pos+1:]...)
+	ln.Header.NumCell--
+	return cell
 }
 
-// return the split node
-func (ln *LeafNode) split(key key) *LeafNode {
+// Move the cells of the upper half of the used bytes to a new right node,
+// then link it to the parent.
+// Both nodes are saved here, the caller should not save ln again
+// because its parent may change when the parent node splits too.
+func (ln *LeafNode) split() error {
+	bt := ln.btree
+
 	right := initEmptyLeafNode()
-	right.Header.CellSize = ln.Header.CellSize
+	right.btree = bt
 	right.Header.Parent = ln.Header.Parent
-
-	// init tree for metadata(next page to insert)
-	if ln.btree == nil {
-		ln.btree = NewBtree()
-		ln.btree.deserialize(ln.btree.pager.ReadPage(0))
-		right.btree = ln.btree
+	right.Header.Height = ln.Header.Height
+	page, err := bt.allocPage()
+	if err != nil {
+		return err
 	}
-	right.Header.Page = PageNum(ln.btree.NumNode + 1)
-	ln.btree.NumNode++
-	right.Cells = make([]*leafCell, right.maxLeafNodeNumCell())
-
-	// move half of the old node cells to the right
-	copy(right.Cells, ln.Cells[ln.Header.NumCell/2:])
-	for i := ln.Header.NumCell / 2; i < ln.Header.NumCell; i++ {
-		ln.Cells[i] = nil
+	right.Header.Page = page
+	bt.NumNode++
+
+	// the left node keeps the cells fitting in half of the used bytes,
+	// the first cell always fits since a cell is at most a quarter of a page
+	half := ln.usedBytes() / 2
+	var used uint32
+	middle := 0
+	for middle < len(ln.Cells) && used+ln.Cells[middle].size() <= half {
+		used += ln.Cells[middle].size()
+		middle++
 	}
-	right.Header.NumCell = (ln.Header.NumCell - ln.Header.NumCell/2)
-	ln.Header.NumCell -= (ln.Header.NumCell - ln.Header.NumCell/2)
+	right.Cells = append([]*leafCell(nil), ln.Cells[middle:]...)
+	ln.Cells = ln.Cells[:middle]
+	right.Header.NumCell = uint16(len(right.Cells))
+	ln.Header.NumCell = uint16(middle)
 
 	right.Header.Next = ln.Header.Next
 	ln.Header.Next = right.Header.Page
 
-	// ln is the original root node
-	if ln.Header.Parent == 0 {
-		newRoot := initEmptyInternalNode()
-		newRoot.btree = ln.btree
-
-		// ln become the leftmost node
-		ln.btree.First = ln.Header.Page
-
-		newRoot.Header.Page = PageNum(ln.btree.NumNode + 1)
-		ln.Header.Parent = newRoot.Header.Page
-		right.Header.Parent = newRoot.Header.Page
-
-		ln.btree.Root = newRoot.Header.Page
-		ln.btree.NumNode++
-
-		newRoot.Cells = make([]*internalCell, maxInternalNodeNumCell())
-		newRoot.Cells[0] = &internalCell{
-			key:  right.Cells[0].key,
-			left: ln.Header.Page,
-		}
-		newRoot.Header.NumCell++
-		if key < right.Cells[0].key {
-			newRoot.Cells[0].key = key // will be inserted into right's leftmost
-		}
-		newRoot.Cells[0].right = right.Header.Page
-
-		ln.btree.save()
-		newRoot.save()
-	} else {
-		// the key that goes to the parent
-		bubbleKey := right.Cells[0].key
-		if key < bubbleKey {
-			bubbleKey = key
-		}
-
-		parent := ln.btree.readNode(ln.Header.Parent)
-		internalCell := &internalCell{
-			key:   bubbleKey,
-			left:  ln.Header.Page,
-			right: right.Header.Page,
-		}
-
-		bytes, err := internalCell.serialize()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		ln.btree.save()
-		parent.saveCell(bubbleKey, bytes)
-	}
-
-	return right
+	// keys >= the first key of the right node go to the right
+	return bt.insertIntoParent(ln, right.Cells[0].key, right)
 }
 
 func (ln *LeafNode) serialize() []byte {
 	page := makeNodePage(constants.MagicNumberLeaf)
 
-	pos := constants.MagicNumberSize // nodes are put after 2 bytes of magic number
+	pos := constants.PageHeaderSize // nodes are put after the magic number and the checksum
 
 	headerBytes := ln.Header.serialize()
 	copy(page[pos:pos+nodeHeaderSize()], headerBytes)
@@ -162,43 +167,48 @@ func (ln *LeafNode) serialize() []byte {
 	return page
 }
 
+// Write the cell pointers and the cells packed at the end of the node body
 func (ln *LeafNode) serializeCells() ([]byte, error) {
-	cells := ln.Cells
-	if len(cells) == 0 || ln.Header.CellSize == 0 {
-		return nil, errors.New("serializing leaf node: empty leaf node or cell size not set")
+	if ln.freeBytes() < 0 {
+		return nil, fmt.Errorf("serializing leaf node: %d bytes of cells, more than the %d bytes of the node body", ln.usedBytes(), nodeBodySize())
 	}
-	dataSize := len(cells) * int(ln.Header.CellSize)
-	buf := make([]byte, dataSize)
-	pos := 0
-
-	for _, cell := range cells {
-		if cell != nil {
-			binary.LittleEndian.PutUint32(buf[pos:], uint32(cell.key))
-			pos = util.AdvanceCursor(pos, constants.BTreeKeySize)
-			copy(buf[pos:], cell.data)
-			pos = util.AdvanceCursor(pos, len(cell.data))
-		}
+	buf := make([]byte, nodeBodySize())
+	end := nodeBodySize()
+
+	for i, cell := range ln.Cells {
+		end -= leafCellHeaderSize + uint32(len(cell.data))
+		binary.LittleEndian.PutUint16(buf[i*leafPointerSize:], uint16(end))
+		binary.LittleEndian.PutUint32(buf[end:], uint32(cell.key))
+		binary.LittleEndian.PutUint16(buf[end+constants.BTreeKeySize:], uint16(len(cell.data)))
+		copy(buf[end+leafCellHeaderSize:], cell.data)
 	}
 
 	return buf, nil
 }
 
 func (ln *LeafNode) deserializeCells(bytes []byte) error {
-	if len(bytes) < int(ln.Header.CellSize)*int(ln.Header.NumCell) {
-		return fmt.Errorf("deserializing leaf node cell: invalid data length -- found %d, expected %d", ln.Header.CellSize, ln.Header.NumCell)
+	pointersEnd := uint32(ln.Header.NumCell) * leafPointerSize
+	if uint32(len(bytes)) < pointersEnd {
+		return fmt.Errorf("deserializing leaf node cell: invalid data length -- found %d, expected at least %d", len(bytes), pointersEnd)
 	}
 
-	ln.Cells = make([]*leafCell, ln.maxLeafNodeNumCell())
-
-	var pos uint32 = 0
-	for i := 0; i < int(ln.Header.NumCell); i++ {
-		data := make([]byte, ln.Header.CellSize-constants.BTreeKeySize)
-		copy(data, bytes[pos+constants.BTreeKeySize:pos+ln.Header.CellSize])
+	ln.Cells = make([]*leafCell, ln.Header.NumCell)
+	for i := range ln.Cells {
+		offset := uint32(binary.LittleEndian.Uint16(bytes[i*leafPointerSize:]))
+		if offset < pointersEnd || offset+leafCellHeaderSize > uint32(len(bytes)) {
+			return fmt.Errorf("deserializing leaf node cell: cell %d at invalid offset %d", i, offset)
+		}
+		size := uint32(binary.LittleEndian.Uint16(bytes[offset+constants.BTreeKeySize:]))
+		start := offset + leafCellHeaderSize
+		if start+size > uint32(len(bytes)) {
+			return fmt.Errorf("deserializing leaf node cell: cell %d of %d bytes at offset %d overflows the node", i, size, offset)
+		}
+		data := make([]byte, size)
+		copy(data, bytes[start:start+size])
 		ln.Cells[i] = &leafCell{
-			key:  key(binary.LittleEndian.Uint32(bytes[pos : pos+constants.BTreeKeySize])),
+			key:  key(binary.LittleEndian.Uint32(bytes[offset:])),
 			data: data,
 		}
-		pos = util.AdvanceCursor(pos, ln.Header.CellSize)
 	}
 	return nil
 }
@@ -211,66 +221,130 @@ func (ln *LeafNode) deserialize(bytes []byte) error {
 	if magicNumber != constants.MagicNumberLeaf {
 		return fmt.Errorf("deserializing leaf node: invalid magic number for leaf node -- %s, expected %s", magicNumber, constants.MagicNumberLeaf)
 	}
-	pos := constants.MagicNumberSize
+	pos := constants.PageHeaderSize
 	err := ln.Header.deserialize(bytes[pos : pos+nodeHeaderSize()])
 	if err != nil {
 		return err
 	}
 	pos = util.AdvanceCursor(pos, nodeHeaderSize())
-	err = ln.deserializeCells(bytes[pos : pos+ln.Header.CellSize*uint32(ln.Header.NumCell)])
+	err = ln.deserializeCells(bytes[pos : pos+nodeBodySize()])
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (ln *LeafNode) saveCell(key key, data []byte) {
-	pos := 0
-	for index, cell := range ln.Cells {
-		if cell == nil || cell.key >= key {
-			pos = index
+func (ln *LeafNode) saveCell(key key, data []byte) error {
+	// insert after the cells with smaller or equal keys
+	pos := int(ln.Header.NumCell)
+	for i := 0; i < int(ln.Header.NumCell); i++ {
+		if ln.Cells[i].key > key {
+			pos = i
 			break
 		}
 	}
 
-	var right *LeafNode
-	if ln.Header.NumCell == uint8(ln.maxLeafNodeNumCell()) {
-		right = ln.split(key)
+	ln.insertCellAt(pos, &leafCell{
+		key:  key,
+		data: data,
+	})
+
+	// split when the cells don't fit in the page anymore
+	if ln.freeBytes() < 0 {
+		return ln.split()
 	}
+	return ln.save()
+}
 
-	// if split, add cell at the right node
-	if right != nil {
-		right.saveCell(key, data)
-		right.save()
-	} else {
-		// move all elements to the right if there's any elements
-		if ln.Cells[pos] != nil {
-			copy(ln.Cells[pos+1:], ln.Cells[pos:])
+// Remove the cell at pos, then rebalance the tree
+func (ln *LeafNode) deleteCellAt(pos int) error {
+	ln.removeCellAt(pos)
+
+	// the first key changed, keep the separator on the left of this node tight
+	if pos == 0 && ln.Header.NumCell > 0 {
+		err := ln.btree.updateSeparator(ln.Header.Page, ln.Header.Parent, ln.Cells[0].key)
+		if err != nil {
+			return err
 		}
-		ln.Cells[pos] = &leafCell{
-			key:  key,
-			data: data,
+	}
+
+	return ln.rebalance()
+}
+
+// Fix an underflow node after deleting or shrinking a cell, by borrowing cells
+// from a sibling or merging with it. The left sibling is preferred, the right
+// one is used when the node is the leftmost child of its parent.
+func (ln *LeafNode) rebalance() error {
+	bt := ln.btree
+
+	// root node can hold any amount of cells
+	if ln.Header.Parent == 0 || ln.usedBytes() >= minLeafBytes() {
+		return ln.save()
+	}
+
+	parent, err := bt.readInternal(ln.Header.Parent)
+	if err != nil {
+		return err
+	}
+	index := parent.childIndex(ln.Header.Page)
+	children := parent.children()
+
+	if index > 0 {
+		left, err := bt.readLeaf(children[index-1])
+		if err != nil {
+			return err
 		}
-		ln.Header.NumCell += 1
-		if ln.Header.NumCell == uint8(ln.maxLeafNodeNumCell()) {
-			right = ln.split(key)
-			right.save()
+		if left.usedBytes()+ln.usedBytes() <= nodeBodySize() {
+			// merge into the left node and drop this one
+			left.Cells = append(left.Cells, ln.Cells...)
+			left.Header.NumCell += ln.Header.NumCell
+			left.Header.Next = ln.Header.Next
+			if err := left.save(); err != nil {
+				return err
+			}
+			if err := bt.dropNode(ln.Header.Page); err != nil {
+				return err
+			}
+			return parent.removeChild(index)
+		}
+		// borrow the last cells of the left node, it holds more than 3/4 of
+		// a page since the nodes don't fit in one, so it stays above the minimum
+		for ln.usedBytes() < minLeafBytes() {
+			ln.insertCellAt(0, left.removeCellAt(int(left.Header.NumCell)-1))
 		}
+		parent.Cells[index-1].key = ln.Cells[0].key
+		return saveNodes(left, ln, parent)
 	}
 
-	ln.save()
+	right, err := bt.readLeaf(children[index+1])
+	if err != nil {
+		return err
+	}
+	if right.usedBytes()+ln.usedBytes() <= nodeBodySize() {
+		// merge the right node into this one and drop it
+		ln.Cells = append(ln.Cells, right.Cells...)
+		ln.Header.NumCell += right.Header.NumCell
+		ln.Header.Next = right.Header.Next
+		if err := ln.save(); err != nil {
+			return err
+		}
+		if err := bt.dropNode(right.Header.Page); err != nil {
+			return err
+		}
+		return parent.removeChild(index + 1)
+	}
+	// borrow the first cells of the right node
+	for ln.usedBytes() < minLeafBytes() {
+		ln.insertCellAt(int(ln.Header.NumCell), right.removeCellAt(0))
+	}
+	parent.Cells[index].key = right.Cells[0].key
+	return saveNodes(right, ln, parent)
 }
 
 func (ln *LeafNode) save() error {
-	if ln.btree == nil {
-		ln.btree = NewBtree()
-	}
-
 	if ln.Header.Page == 0 {
-		return fmt.Errorf("saving internal node: invalid node page: %d", ln.Header.Page)
+		return fmt.Errorf("saving leaf node: invalid node page: %d", ln.Header.Page)
 	}
 
-	ln.btree.pager.WritePage(uint32(ln.Header.Page), ln.serialize())
-
-	return nil
+	return ln.btree.pager.WritePage(uint32(ln.Header.Page), ln.serialize())
 }
@@ -9,23 +9,32 @@ import (
 	"github.com/tomial/go-db/internal/util"
 )
 
-func TestLeafNodeCellSize(t *testing.T) {
-	ln := initLeafNode()
-	ln.SetCellSize(520)
-	size := ln.Header.CellSize
-	expected := 524 // key + table row size
+func TestLeafCellSize(t *testing.T) {
+	cell := &leafCell{key: 1, data: make([]byte, 520)}
+	size := cell.size()
+	expected := 528 // pointer + key + data size + table row size
 	if size != uint32(expected) {
-		t.Fatalf("Wrong leaf node cell size: %d, expected %d", size, expected)
+		t.Fatalf("Wrong leaf cell size: %d, expected %d", size, expected)
 	}
 }
 
-func TestMaxLeafNodeNumCell(t *testing.T) {
-	lf := initLeafNode()
-	lf.SetCellSize(520)
-	maxNum := lf.maxLeafNodeNumCell()
-	expected := 7
-	if maxNum != uint32(expected) {
-		t.Fatalf("Wrong max leaf node cell num: %d, expected %d", maxNum, expected)
+func TestMaxDataSize(t *testing.T) {
+	size := MaxDataSize()
+	expected := 1009 // a quarter of the node body, less the pointer and the cell header
+	if size != uint32(expected) {
+		t.Fatalf("Wrong max data size: %d, expected %d", size, expected)
+	}
+}
+
+// A leaf takes as many small cells as fit in its bytes
+func TestLeafNodeFreeBytes(t *testing.T) {
+	ln := initEmptyLeafNode()
+	for ln.freeBytes() >= 0 {
+		ln.insertCellAt(int(ln.Header.NumCell), &leafCell{key: key(ln.Header.NumCell), data: []byte("a a@b")})
+	}
+	expected := 4070 / 13
+	if num := int(ln.Header.NumCell) - 1; num != expected {
+		t.Fatalf("Wrong leaf node cell num: %d, expected %d", num, expected)
 	}
 }
 
@@ -39,7 +48,6 @@ func TestMakeLeafNodeEmptyPage(t *testing.T) {
 
 func initLeafNode() *LeafNode {
 	ln := &LeafNode{Header: initNodeHeader()}
-	ln.SetCellSize(520)
 	testBytes := make([]byte, 520)
 	testBytes[0] = 0xAB
 	testBytes[1] = 0xCD
@@ -63,28 +71,38 @@ func initLeafNode() *LeafNode {
 
 func TestSerializeLeafCells(t *testing.T) {
 	ln := initLeafNode()
+	ln.Cells[1].data = []byte{0xEF}
 	bytes, err := ln.serializeCells()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(bytes) != int(ln.Header.CellSize)*3 {
-		t.Fatalf("Serialize leaf cells: invalid cell size -- %d, expected %d\n", len(bytes), ln.Header.CellSize*3)
+	if len(bytes) != int(nodeBodySize()) {
+		t.Fatalf("Serialize leaf cells: invalid body size -- %d, expected %d\n", len(bytes), nodeBodySize())
 	}
 
-	pos := 0
-	keyBytes := bytes[pos : pos+constants.BTreeKeySize]
-	key := binary.LittleEndian.Uint32(keyBytes)
-	pos = util.AdvanceCursor(pos, constants.BTreeKeySize)
-	if key != 1 || bytes[pos] != 0xAB || bytes[pos+1] != 0xCD {
-		t.Fatalf("Serialize leaf cells: invalid cell bytes, found %v %v, expected %v %v", bytes[pos], bytes[pos+1], 0xAB, 0xCD)
+	// cells are packed from the end of the body in key order
+	offsets := []int{4070 - 526, 4070 - 526 - 7}
+	for i, offset := range offsets {
+		pos := i * leafPointerSize
+		if pointer := int(binary.LittleEndian.Uint16(bytes[pos:])); pointer != offset {
+			t.Fatalf("Serialize leaf cells: pointer %d is %d, expected %d", i, pointer, offset)
+		}
 	}
 
-	pos = int(ln.Header.CellSize)
-	keyBytes = bytes[pos : pos+constants.BTreeKeySize]
-	key = binary.LittleEndian.Uint32(keyBytes)
+	pos := offsets[0]
+	key := binary.LittleEndian.Uint32(bytes[pos:])
 	pos = util.AdvanceCursor(pos, constants.BTreeKeySize)
-	if key != 2 || bytes[pos] != 0xAB || bytes[pos+1] != 0xCD {
-		t.Fatalf("Serialize leaf cells: invalid cell bytes, found %v %v, expected %v %v", bytes[pos], bytes[pos+1], 0xAB, 0xCD)
+	size := binary.LittleEndian.Uint16(bytes[pos:])
+	pos = util.AdvanceCursor(pos, 2)
+	if key != 1 || size != 520 || bytes[pos] != 0xAB || bytes[pos+1] != 0xCD {
+		t.Fatalf("Serialize leaf cells: invalid cell bytes, found key %d size %d %v %v, expected 1 520 %v %v", key, size, bytes[pos], bytes[pos+1], 0xAB, 0xCD)
+	}
+
+	pos = offsets[1]
+	key = binary.LittleEndian.Uint32(bytes[pos:])
+	size = binary.LittleEndian.Uint16(bytes[pos+constants.BTreeKeySize:])
+	if key != 2 || size != 1 || bytes[pos+leafCellHeaderSize] != 0xEF {
+		t.Fatalf("Serialize leaf cells: invalid cell bytes, found key %d size %d %v, expected 2 1 %v", key, size, bytes[pos+leafCellHeaderSize], 0xEF)
 	}
 }
 
@@ -109,6 +127,7 @@ func TestLeafNodeSerialization(t *testing.T) {
 		ln.Cells[0].key != ln1.Cells[0].key ||
 		ln.Cells[1].key != ln1.Cells[1].key ||
 		ln.Cells[2].key != ln1.Cells[2].key ||
+		len(ln.Cells[0].data) != len(ln1.Cells[0].data) ||
 		ln.Cells[0].data[0] != ln1.Cells[0].data[0] ||
 		ln.Cells[0].data[1] != ln1.Cells[0].data[1] {
 		t.Fatalf("Testing leaf node serialization: cannot serialize and deserialize leaf node correctly")
@@ -12,9 +12,10 @@ type node interface {
 	deserialize(bytes []byte) error
 	serializeCells() ([]byte, error)
 	deserializeCells(bytes []byte) error
-	find(key key) (found bool, data []byte)
-	saveCell(key key, data []byte)
-	searchLeaf(key key) *LeafNode
+	saveCell(key key, data []byte) error
+	searchLeaf(key key) (*LeafNode, error)
+	header() *nodeHeader
+	save() error
 }
 
 const (
@@ -29,14 +29,14 @@ type PageNum uint32
 
 // Common fields of leaf and internal node
 type nodeHeader struct {
-	// Headers: 19B
+	// Headers: 20B
 	Typ      NodeType // 1B
 	Parent   PageNum  // 4B Pointer to parent node (read actual struct with PageNum)
 	Next     PageNum  // 4B Pointer to next leaf node (page 0 is tree struct, used as nil here)
 	Page     PageNum
-	CellSize uint32 // 4B Size of node cell, The cell size of leaf node depends on what table(row) it stores
+	CellSize uint32 // 4B Size of internal node cell, 0 for leaf nodes whose cells have variable sizes
 	Height   uint8
-	NumCell  uint8 // 1B Amount of cells(cell content : internal - pointer to child, leaf - data)
+	NumCell  uint16 // 2B Amount of cells(cell content : internal - pointer to child, leaf - data)
 }
 
 func initHeader(typ NodeType) *nodeHeader {
@@ -64,7 +64,7 @@ func nodeHeaderSize() uint32 {
 }
 
 func nodeBodySize() uint32 {
-	return uint32(constants.PageSize) - nodeHeaderSize() - constants.MagicNumberSize
+	return uint32(constants.PageSize) - nodeHeaderSize() - constants.PageHeaderSize
 }
 
 func (header nodeHeader) serialize() []byte {
@@ -80,6 +80,11 @@ func (header nodeHeader) serialize() []byte {
 				buf[pos] = byte(val.Field(i).Uint())
 				pos = util.AdvanceCursor(pos, 1)
 			}
+		case reflect.Uint16:
+			{
+				binary.LittleEndian.PutUint16(buf[pos:pos+2], uint16(val.Field(i).Uint()))
+				pos = util.AdvanceCursor(pos, 2)
+			}
 		case reflect.Uint32:
 			{
 				binary.LittleEndian.PutUint32(buf[pos:pos+4], uint32(val.Field(i).Uint()))
@@ -109,7 +114,7 @@ func (header *nodeHeader) deserialize(bytes []byte) error {
 	pos = util.AdvanceCursor(pos, 4)
 	header.Height = uint8(bytes[pos])
 	pos = util.AdvanceCursor(pos, 1)
-	header.NumCell = uint8(bytes[pos])
+	header.NumCell = binary.LittleEndian.Uint16(bytes[pos : pos+2])
 
 	return nil
 }
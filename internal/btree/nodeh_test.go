@@ -18,7 +18,7 @@ func initNodeHeader() *nodeHeader {
 
 func TestNodeHeaderSize(t *testing.T) {
 	size := nodeHeaderSize()
-	var expected uint32 = 19
+	var expected uint32 = 20
 	if size != expected {
 		t.Fatalf("Wrong node header size: %d, expected %d", size, expected)
 	}
@@ -26,7 +26,7 @@ func TestNodeHeaderSize(t *testing.T) {
 
 func TestNodeBodySize(t *testing.T) {
 	size := nodeBodySize()
-	var expected uint32 = 4075
+	var expected uint32 = 4070
 	if size != expected {
 		t.Fatalf("Wrong node body size: %d, expected %d", size, expected)
 	}
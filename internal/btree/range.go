@@ -0,0 +1,64 @@
+package btree
+
+import "math"
+
+// One end of a key range
+type Bound struct {
+	Key       uint32
+	Inclusive bool
+	Unbounded bool // no limit on this end, Key is ignored
+}
+
+// The key is not under the bound when used as a lower bound
+func (b Bound) admitsAbove(k uint32) bool {
+	return b.Unbounded || k > b.Key || (b.Inclusive && k == b.Key)
+}
+
+// The key is not over the bound when used as an upper bound
+func (b Bound) admitsBelow(k uint32) bool {
+	return b.Unbounded || k < b.Key || (b.Inclusive && k == b.Key)
+}
+
+// Call fn with every cell between lower and upper, in key order or reverse order.
+// The cursor seeks to one end of the range, then walks the leaves until the other end.
+// Stops when fn returns false, returns the error of a failed page read.
+func (bt *BTree) Range(lower, upper Bound, reverse bool, fn func(key uint32, data []byte) bool) error {
+	c := bt.Cursor()
+
+	if !reverse {
+		if lower.Unbounded {
+			c.First()
+		} else {
+			c.Seek(lower.Key)
+		}
+		for ; c.Valid() && upper.admitsBelow(c.Key()); c.Next() {
+			if lower.admitsAbove(c.Key()) && !fn(c.Key(), c.Value()) {
+				return nil
+			}
+		}
+		return c.Err()
+	}
+
+	if upper.Unbounded || (upper.Inclusive && upper.Key == math.MaxUint32) {
+		c.Last()
+	} else {
+		// the first key after the range, then step back into it,
+		// so the cursor is at the last one of duplicate upper keys
+		after := upper.Key
+		if upper.Inclusive {
+			after++
+		}
+		c.Seek(after)
+		if c.Valid() {
+			c.Prev()
+		} else if c.Err() == nil {
+			c.Last()
+		}
+	}
+	for ; c.Valid() && lower.admitsAbove(c.Key()); c.Prev() {
+		if !fn(c.Key(), c.Value()) {
+			return nil
+		}
+	}
+	return c.Err()
+}
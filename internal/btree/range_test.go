@@ -0,0 +1,63 @@
+package btree
+
+import (
+	"testing"
+)
+
+func collectRange(bt *BTree, lower, upper Bound, reverse bool) []uint32 {
+	var keys []uint32
+	bt.Range(lower, upper, reverse, func(key uint32, data []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestRange(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	// even keys 2..200, spread over many leaves
+	var keys []int
+	for i := 2; i <= 200; i += 2 {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+
+	all := Bound{Unbounded: true}
+	cases := []struct {
+		name         string
+		lower, upper Bound
+		reverse      bool
+		first, last  uint32
+		count        int
+	}{
+		{"all", all, all, false, 2, 200, 100},
+		{"all reverse", all, all, true, 200, 2, 100},
+		{"inclusive", Bound{Key: 10, Inclusive: true}, Bound{Key: 20, Inclusive: true}, false, 10, 20, 6},
+		{"exclusive", Bound{Key: 10}, Bound{Key: 20}, false, 12, 18, 4},
+		{"missing bounds", Bound{Key: 11, Inclusive: true}, Bound{Key: 21, Inclusive: true}, false, 12, 20, 5},
+		{"inclusive reverse", Bound{Key: 10, Inclusive: true}, Bound{Key: 20, Inclusive: true}, true, 20, 10, 6},
+		{"exclusive reverse", Bound{Key: 10}, Bound{Key: 20}, true, 18, 12, 4},
+		{"open upper", Bound{Key: 190}, all, false, 192, 200, 5},
+		{"open lower reverse", all, Bound{Key: 9, Inclusive: true}, true, 8, 2, 4},
+		{"upper past the end reverse", Bound{Key: 195, Inclusive: true}, Bound{Key: 500, Inclusive: true}, true, 200, 196, 3},
+	}
+	for _, c := range cases {
+		found := collectRange(bt, c.lower, c.upper, c.reverse)
+		if len(found) != c.count || found[0] != c.first || found[len(found)-1] != c.last {
+			t.Fatalf("Range %s: found %v, expected %d keys from %d to %d", c.name, found, c.count, c.first, c.last)
+		}
+		for i := 1; i < len(found); i++ {
+			if (found[i] < found[i-1]) != c.reverse {
+				t.Fatalf("Range %s: keys out of order %v", c.name, found)
+			}
+		}
+	}
+
+	if found := collectRange(bt, Bound{Key: 21, Inclusive: true}, Bound{Key: 21, Inclusive: true}, false); len(found) != 0 {
+		t.Fatalf("Range: found %v in an empty range", found)
+	}
+	if found := collectRange(bt, Bound{Key: 30}, Bound{Key: 10}, true); len(found) != 0 {
+		t.Fatalf("Range: found %v with lower bound over upper bound", found)
+	}
+}
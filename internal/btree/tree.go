@@ -3,11 +3,10 @@ package btree
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
 	"reflect"
+	"slices"
 
 	"github.com/tomial/go-db/internal/constants"
 	"github.com/tomial/go-db/internal/pager"
@@ -16,6 +15,18 @@ import (
 
 type key uint32
 
+// How a tree handles inserting a key that already exists
+type KeyMode uint32
+
+const (
+	KeyModeUnique    KeyMode = iota // Insert returns ErrDuplicateKey
+	KeyModeDuplicate                // Store another cell after the existing ones with the key
+)
+
+var ErrDuplicateKey = errors.New("duplicate key")
+var ErrKeyNotFound = errors.New("key not found")
+var ErrDataTooLarge = errors.New("data too large")
+
 // How to build a btree:
 // New file:
 // Create a tree struct and a root node, save it to file
@@ -32,30 +43,66 @@ type BTree struct {
 	Root    PageNum // Root node's page num
 	First   PageNum // Leftmost leaf node, for iteration
 	NumNode uint32
+	KeyMode KeyMode
+	Free    PageNum // First page of the freelist, 0 if it's empty
+	NumFree uint32
 	pager   *pager.Pager
+	file    *BTree // tree on page 0 of the file, which holds the freelist
+
+	// saves the header of a tree opened with OpenTree, nil for the tree on page 0
+	saveHeader func(Header) error
 }
 
-func NewBtree() *BTree {
-	file, err := os.OpenFile(constants.DbFileName, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatalf("BTree: failed to open database file %s -- %s", constants.DbFileName, err)
+// The fields of a tree opened with OpenTree, stored by the caller
+type Header struct {
+	Root    PageNum
+	First   PageNum
+	NumNode uint32
+	KeyMode KeyMode
+}
+
+// Open the tree stored in the pager's file, page 0 holds the tree struct.
+// An empty file gets a new tree with the key mode, an existing one keeps
+// the mode it was created with
+func Open(p *pager.Pager, mode KeyMode) (*BTree, error) {
+	bt := &BTree{Root: 0, First: 0, NumNode: 0, KeyMode: mode, pager: p} // No root and first node
+	bt.file = bt
+	var err error
+	if p.NumPages() == 0 { // New file
+		err = bt.save()
+	} else { // Existing file
+		err = bt.loadTree()
 	}
-	fstat, err := file.Stat()
 	if err != nil {
-		log.Fatalf(("New btree: failed to get db file stat -- %s\n"), err.Error())
+		return nil, err
 	}
-	file.Seek(0, io.SeekStart)
-	bt := &BTree{Root: 0, First: 0, NumNode: 0, pager: pager.Init(file)} // No root and first node
-	if fstat.Size() == 0 {                                               // New file
-		bin := bt.serialize()
-		_, err := file.Write(bin)
-		if err != nil {
-			log.Fatalf("Creating btree: failed to write btree binary to db file -- %s", err.Error())
-		}
-	} else { // Existing file
-		bt.loadTree()
+	return bt, nil
+}
+
+// Open another tree stored in the file of bt, sharing its pager and its
+// freelist. The tree has no page of its own for its header, save is called
+// with the header every time it changes and the caller stores it.
+// An empty header opens a new empty tree.
+func (bt *BTree) OpenTree(header Header, save func(Header) error) *BTree {
+	return &BTree{
+		Root:       header.Root,
+		First:      header.First,
+		NumNode:    header.NumNode,
+		KeyMode:    header.KeyMode,
+		pager:      bt.pager,
+		file:       bt.file,
+		saveHeader: save,
 	}
-	return bt
+}
+
+func (bt *BTree) Header() Header {
+	return Header{Root: bt.Root, First: bt.First, NumNode: bt.NumNode, KeyMode: bt.KeyMode}
+}
+
+// Read the struct of the tree on page 0 back, after the pager discarded the
+// pages written since it was last flushed
+func (bt *BTree) Reload() error {
+	return bt.loadTree()
 }
 
 func (bt *BTree) structSize() uint {
@@ -87,7 +134,7 @@ func (bt *BTree) serialize() []byte {
 		}
 	}
 	treePage := makeNodePage(constants.MagicNumberTree)
-	copy(treePage[constants.MagicNumberSize:], buf)
+	copy(treePage[constants.PageHeaderSize:], buf)
 	return treePage
 }
 
@@ -95,74 +142,321 @@ func (bt *BTree) deserialize(page []byte) error {
 	pageSize := len(page)
 	if pageSize != int(constants.PageSize) {
 		return fmt.Errorf("deserializing btree: wrong btree page size %d, expected %d", pageSize, constants.PageSize)
-	} else {
-		data := page[constants.MagicNumberSize:]
-		bt.Root = PageNum(binary.LittleEndian.Uint32(data[:4]))
-		bt.First = PageNum(binary.LittleEndian.Uint32(data[4:8]))
-		bt.NumNode = binary.LittleEndian.Uint32(data[8:])
-		return nil
 	}
+	switch magicNumber := hex.EncodeToString(page[:constants.MagicNumberSize]); {
+	case magicNumber == constants.MagicNumberTree:
+	case slices.Contains(constants.LegacyMagicNumbers, magicNumber):
+		return fmt.Errorf("deserializing btree: %w: magic number %s of a file written by an older version", pager.ErrUnsupportedFormat, magicNumber)
+	default:
+		return fmt.Errorf("deserializing btree: invalid magic number %s, expected %s", magicNumber, constants.MagicNumberTree)
+	}
+	data := page[constants.PageHeaderSize:]
+	bt.Root = PageNum(binary.LittleEndian.Uint32(data[:4]))
+	bt.First = PageNum(binary.LittleEndian.Uint32(data[4:8]))
+	bt.NumNode = binary.LittleEndian.Uint32(data[8:12])
+	bt.KeyMode = KeyMode(binary.LittleEndian.Uint32(data[12:16]))
+	bt.Free = PageNum(binary.LittleEndian.Uint32(data[16:20]))
+	bt.NumFree = binary.LittleEndian.Uint32(data[20:24])
+	return nil
 }
 
-func (bt *BTree) Insert(index uint32, data []byte) {
+func (bt *BTree) Insert(index uint32, data []byte) error {
+	if err := checkDataSize(index, data); err != nil {
+		return err
+	}
 	// Empty Tree
-	// Create a root node to page 1 and insert
+	// Create a root node and insert
 	if bt.Root == 0 {
-		root := createRootNode(data)
-		root.saveCell(key(index), data)
-		bt.Root = 1
+		root := initEmptyRootNode()
+		root.btree = bt
+		page, err := bt.allocPage()
+		if err != nil {
+			return err
+		}
+		root.Header.Page = page
+		bt.Root = root.Header.Page
 		bt.NumNode += 1
-		bt.First = 1
-		bt.save()
-	} else {
-		// find the leaf node and insert it
-		ln := bt.searchLeaf(key(index))
-		if ln == nil {
-			log.Fatalln("BTree insert: failed to find leaf node to insert")
+		bt.First = root.Header.Page
+		if err := root.saveCell(key(index), data); err != nil {
+			return err
 		}
-		// If the node split, the original page would be changed
-		ln.saveCell(key(index), data)
+		return bt.save()
 	}
+	// find the leaf node and insert it
+	ln, err := bt.searchLeaf(key(index))
+	if err != nil {
+		return err
+	}
+	// keys equal to a separator are on its right, so an existing key must be in this leaf
+	if bt.KeyMode == KeyModeUnique && ln.cellIndex(key(index)) >= 0 {
+		return fmt.Errorf("%w: %d", ErrDuplicateKey, index)
+	}
+	// If the node split, the original page would be changed
+	if err := ln.saveCell(key(index), data); err != nil {
+		return err
+	}
+	return bt.save()
 }
 
-func (bt *BTree) searchLeaf(key key) *LeafNode {
-	node := bt.readNode(bt.Root)
+func (bt *BTree) searchLeaf(key key) (*LeafNode, error) {
+	node, err := bt.readNode(bt.Root)
+	if err != nil {
+		return nil, err
+	}
 	return node.searchLeaf(key)
 }
 
-func createRootNode(data []byte) *LeafNode {
-	ln := initEmptyRootNode()
-	ln.SetCellSize(uint32(len(data)))
-	ln.Cells = make([]*leafCell, ln.maxLeafNodeNumCell())
-	ln.Header.Page = 1
-	return ln
+// A leaf holds at least 4 cells, returns ErrDataTooLarge for larger data
+func checkDataSize(index uint32, data []byte) error {
+	if uint32(len(data)) > MaxDataSize() {
+		return fmt.Errorf("%w: %d bytes for key %d, the maximum is %d", ErrDataTooLarge, len(data), index, MaxDataSize())
+	}
+	return nil
+}
+
+// Overwrite the data of the first cell with the key, returns ErrKeyNotFound if there's no such cell.
+// The leaf splits when the cell grows out of its page, and borrows from or
+// merges with a sibling when it shrinks below the minimum.
+func (bt *BTree) Update(index uint32, data []byte) error {
+	if err := checkDataSize(index, data); err != nil {
+		return err
+	}
+	c := bt.Cursor()
+	c.Seek(index)
+	if c.Err() != nil {
+		return c.Err()
+	}
+	if !c.Valid() || c.Key() != index {
+		return fmt.Errorf("%w: %d", ErrKeyNotFound, index)
+	}
+	ln := c.leaf
+	grown := len(data) > len(ln.Cells[c.index].data)
+	ln.Cells[c.index].data = data
+	switch {
+	case ln.freeBytes() < 0:
+		if err := ln.split(); err != nil {
+			return err
+		}
+	case !grown:
+		if err := ln.rebalance(); err != nil {
+			return err
+		}
+	default:
+		return ln.save()
+	}
+	return bt.save()
 }
 
-func (bt *BTree) Search(index uint32) (found bool, data []byte) {
-	if bt.NumNode == 0 {
-		return false, nil
+// Overwrite the data of the first cell with the key, or insert it if the key is not found
+func (bt *BTree) Upsert(index uint32, data []byte) (replaced bool, err error) {
+	err = bt.Update(index, data)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, bt.Insert(index, data)
 	}
-	page := bt.pager.ReadPage(uint32(bt.Root))
-	switch nodeType(page) {
-	case TypeLeaf:
-		{
-			ln := initEmptyLeafNode()
-			ln.deserialize(page)
-			return ln.find(key(index))
+	return err == nil, err
+}
+
+// The leftmost leaf that may have the key. With duplicate keys, a run of
+// equal keys may span several leaves and the separators between them are
+// equal to the key, so keys equal to a separator go to its left here.
+// The first cell with the key can still be in a following leaf.
+func (bt *BTree) lowerBoundLeaf(key key) (*LeafNode, error) {
+	page := bt.Root
+	for {
+		n, err := bt.readNode(page)
+		if err != nil {
+			return nil, err
 		}
-	case TypeInternal:
-		{
-			in := initEmptyInternalNode()
-			in.deserialize(page)
-			return in.find(key(index))
+		switch n := n.(type) {
+		case *LeafNode:
+			return n, nil
+		case *InternalNode:
+			page = n.lowerBoundChild(key)
 		}
 	}
+}
+
+// Returns the data of the first cell with the key
+func (bt *BTree) Search(index uint32) (found bool, data []byte, err error) {
+	c := bt.Cursor()
+	c.Seek(index)
+	if !c.Valid() || c.Key() != index {
+		return false, nil, c.Err()
+	}
+	return true, c.Value(), nil
+}
+
+// Returns the data of every cell with the key, in insertion order
+func (bt *BTree) SearchAll(index uint32) ([][]byte, error) {
+	var values [][]byte
+	c := bt.Cursor()
+	for c.Seek(index); c.Valid() && c.Key() == index; c.Next() {
+		values = append(values, c.Value())
+	}
+	return values, c.Err()
+}
+
+// Delete every cell with the key, returns false if the key is not found.
+// Nodes less than half full borrow from or merge with a sibling,
+// the root collapses when it's left with a single child.
+func (bt *BTree) Delete(index uint32) (bool, error) {
+	deleted := false
+	c := bt.Cursor()
+	for c.Seek(index); c.Valid() && c.Key() == index; c.Seek(index) {
+		if err := c.leaf.deleteCellAt(c.index); err != nil {
+			return deleted, err
+		}
+		deleted = true
+	}
+	if c.Err() != nil {
+		return deleted, c.Err()
+	}
+	if deleted {
+		return true, bt.save()
+	}
 	return false, nil
 }
 
-func (bt *BTree) Delete(key key) {}
+// The rightmost leaf under the node at page
+func (bt *BTree) lastLeaf(page PageNum) (*LeafNode, error) {
+	for {
+		n, err := bt.readNode(page)
+		if err != nil {
+			return nil, err
+		}
+		switch n := n.(type) {
+		case *LeafNode:
+			return n, nil
+		case *InternalNode:
+			page = n.Cells[n.Header.NumCell-1].right
+		}
+	}
+}
+
+// The leaf before ln in key order, nil if ln is the first one.
+// Leaves only link to the next one, so go up through the parents
+// until there's a subtree on the left, then take its rightmost leaf.
+func (bt *BTree) prevLeaf(ln *LeafNode) (*LeafNode, error) {
+	page, parentPage := ln.Header.Page, ln.Header.Parent
+	for parentPage != 0 {
+		parent, err := bt.readInternal(parentPage)
+		if err != nil {
+			return nil, err
+		}
+		index := parent.childIndex(page)
+		if index > 0 {
+			return bt.lastLeaf(parent.children()[index-1])
+		}
+		page = parentPage
+		parentPage = parent.Header.Parent
+	}
+	return nil, nil
+}
+
+// Link the new right node after left in their parent, create a new root if left is the root.
+// left and right are saved before the parent, so the parent could split and
+// update their Parent pointers on disk.
+func (bt *BTree) insertIntoParent(left node, key key, right node) error {
+	lh, rh := left.header(), right.header()
+
+	if lh.Parent == 0 {
+		newRoot := initEmptyInternalNode()
+		newRoot.btree = bt
+		newRoot.Header.Typ = TypeRoot
+		page, err := bt.allocPage()
+		if err != nil {
+			return err
+		}
+		newRoot.Header.Page = page
+		newRoot.Header.Height = lh.Height + 1
+		bt.NumNode++
+		bt.Root = newRoot.Header.Page
+
+		newRoot.Cells = make([]*internalCell, maxInternalNodeNumCell()+1)
+		newRoot.Cells[0] = &internalCell{
+			key:   key,
+			left:  lh.Page,
+			right: rh.Page,
+		}
+		newRoot.Header.NumCell++
 
-func FullScan() {}
+		// left is not the root anymore, it has the same type as the new right node
+		lh.Typ = rh.Typ
+		lh.Parent = newRoot.Header.Page
+		rh.Parent = newRoot.Header.Page
+
+		return saveNodes(left, right, newRoot, bt)
+	}
+
+	if err := saveNodes(left, right); err != nil {
+		return err
+	}
+
+	parent, err := bt.readNode(lh.Parent)
+	if err != nil {
+		return err
+	}
+	cell := &internalCell{
+		key:   key,
+		left:  lh.Page,
+		right: rh.Page,
+	}
+	bytes, err := cell.serialize()
+	if err != nil {
+		return err
+	}
+	return parent.saveCell(key, bytes)
+}
+
+// Set the key on the left of the node to its new first key,
+// the key is in the nearest ancestor where the node is not in the leftmost subtree
+func (bt *BTree) updateSeparator(page PageNum, parentPage PageNum, first key) error {
+	for parentPage != 0 {
+		parent, err := bt.readInternal(parentPage)
+		if err != nil {
+			return err
+		}
+		index := parent.childIndex(page)
+		if index > 0 {
+			parent.Cells[index-1].key = first
+			return parent.save()
+		}
+		page = parentPage
+		parentPage = parent.Header.Parent
+	}
+	return nil
+}
+
+// The only child of the root becomes the new root
+func (bt *BTree) collapseRoot(root *InternalNode, child PageNum) error {
+	n, err := bt.readNode(child)
+	if err != nil {
+		return err
+	}
+	n.header().Parent = 0
+	n.header().Typ = TypeRoot
+	if err := n.save(); err != nil {
+		return err
+	}
+
+	if err := bt.dropNode(root.Header.Page); err != nil {
+		return err
+	}
+	bt.Root = child
+	if _, ok := n.(*LeafNode); ok {
+		bt.First = child
+	}
+	return nil
+}
+
+func (bt *BTree) setParent(page PageNum, parent PageNum) error {
+	n, err := bt.readNode(page)
+	if err != nil {
+		return err
+	}
+	n.header().Parent = parent
+	return n.save()
+}
 
 func nodeType(page []byte) NodeType {
 	typ := hex.EncodeToString(page[:constants.MagicNumberSize])
@@ -182,63 +476,89 @@ func nodeType(page []byte) NodeType {
 	}
 }
 
-func (bt *BTree) readNode(page PageNum) node {
-	bytes := bt.pager.ReadPage(uint32(page))
+func (bt *BTree) readNode(page PageNum) (node, error) {
+	bytes, err := bt.pager.ReadPage(uint32(page))
+	if err != nil {
+		return nil, err
+	}
 	switch nodeType(bytes) {
 	case TypeLeaf:
 		{
 			ln := initEmptyLeafNode()
 			err := ln.deserialize(bytes)
 			if err != nil {
-				log.Fatal(err)
+				return nil, fmt.Errorf("reading node at page %d: %w", page, err)
 			}
-			return ln
+			ln.btree = bt
+			return ln, nil
 		}
 	case TypeInternal:
 		{
 			in := initEmptyInternalNode()
 			err := in.deserialize(bytes)
 			if err != nil {
-				log.Fatal(err)
+				return nil, fmt.Errorf("reading node at page %d: %w", page, err)
 			}
-			return in
+			in.btree = bt
+			return in, nil
 		}
 	default:
 		{
-			return nil
+			return nil, fmt.Errorf("reading node at page %d: invalid magic number %s", page, hex.EncodeToString(bytes[:constants.MagicNumberSize]))
 		}
 	}
 }
 
-// save tree metadata
-func (bt *BTree) save() {
-	bytes := bt.serialize()
-	bt.pager.WritePage(0, bytes)
+func (bt *BTree) readLeaf(page PageNum) (*LeafNode, error) {
+	n, err := bt.readNode(page)
+	if err != nil {
+		return nil, err
+	}
+	ln, ok := n.(*LeafNode)
+	if !ok {
+		return nil, fmt.Errorf("reading leaf node: page %d is an internal node", page)
+	}
+	return ln, nil
 }
 
-func (bt *BTree) loadTree() {
-	bin := make([]byte, constants.PageSize)
-	_, err := bt.pager.File.Read(bin)
+func (bt *BTree) readInternal(page PageNum) (*InternalNode, error) {
+	n, err := bt.readNode(page)
 	if err != nil {
-		log.Fatalf("Creating btree: failed to read from db file -- %s", err.Error())
+		return nil, err
 	}
-	err = bt.deserialize(bin)
-	if err != nil {
-		log.Fatal(err)
+	in, ok := n.(*InternalNode)
+	if !ok {
+		return nil, fmt.Errorf("reading internal node: page %d is a leaf node", page)
 	}
+	return in, nil
 }
 
-func (bt *BTree) reload() {
-	if bt.pager.File == nil {
-		file, err := os.OpenFile(constants.DbFileName, os.O_RDWR|os.O_CREATE, 0755)
-		if err != nil {
-			log.Fatalf("reloading btree: failed to open database file %s -- %s", constants.DbFileName, err)
+// Save the nodes in order, stop at the first error
+func saveNodes(nodes ...interface{ save() error }) error {
+	for _, n := range nodes {
+		if err := n.save(); err != nil {
+			return err
 		}
-		bt.pager.File = file
 	}
-	bytes := bt.pager.ReadPage(0)
-	bt.deserialize(bytes)
+	return nil
 }
 
-// TODO Draw the whole tree
-func Visualize() {}
+// save tree metadata, with the freelist of the file
+func (bt *BTree) save() error {
+	if bt.saveHeader != nil {
+		if err := bt.saveHeader(bt.Header()); err != nil {
+			return err
+		}
+		return bt.file.save()
+	}
+	bytes := bt.serialize()
+	return bt.pager.WritePage(0, bytes)
+}
+
+func (bt *BTree) loadTree() error {
+	bin, err := bt.pager.ReadPage(0)
+	if err != nil {
+		return err
+	}
+	return bt.deserialize(bin)
+}
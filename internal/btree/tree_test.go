@@ -1,30 +1,38 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/tomial/go-db/internal/constants"
+	"github.com/tomial/go-db/internal/pager"
 )
 
 func TestBTreeStructSize(t *testing.T) {
 	bt := &BTree{}
 	size := bt.structSize()
-	var expected uint = 12
+	var expected uint = 24
 	if size != expected {
 		t.Errorf("Wrong btree struct size %d, expected %d\n", size, expected)
 	}
 }
 
 func TestBTreeSerialization(t *testing.T) {
-	bt := &BTree{Root: 123, First: 321, NumNode: 111}
+	bt := &BTree{Root: 123, First: 321, NumNode: 111, KeyMode: KeyModeDuplicate, Free: 42, NumFree: 3}
 	bin := bt.serialize()
 	// reset values
 	bt.Root = 0
 	bt.First = 0
 	bt.NumNode = 0
+	bt.KeyMode = KeyModeUnique
+	bt.Free = 0
+	bt.NumFree = 0
 	err := bt.deserialize(bin)
 	if err != nil {
 		t.Error(err.Error())
@@ -35,6 +43,12 @@ func TestBTreeSerialization(t *testing.T) {
 	if bt.Root != expectedRoot || bt.First != expectedFirst || bt.NumNode != expectedNumNode {
 		t.Errorf("Serialize btree: Wrong root %d and first %d numNode %d, expected %d and %d and %d\n", bt.Root, bt.First, bt.NumNode, expectedRoot, expectedFirst, expectedNumNode)
 	}
+	if bt.KeyMode != KeyModeDuplicate {
+		t.Errorf("Serialize btree: Wrong key mode %d, expected %d\n", bt.KeyMode, KeyModeDuplicate)
+	}
+	if bt.Free != 42 || bt.NumFree != 3 {
+		t.Errorf("Serialize btree: Wrong freelist %d with %d pages, expected %d with %d\n", bt.Free, bt.NumFree, 42, 3)
+	}
 }
 
 func TestBTreeDeserializationError(t *testing.T) {
@@ -46,6 +60,18 @@ func TestBTreeDeserializationError(t *testing.T) {
 	}
 }
 
+func TestBTreeDeserializeOldFormat(t *testing.T) {
+	bt := &BTree{}
+	for _, magicNumber := range constants.LegacyMagicNumbers {
+		if err := bt.deserialize(makeNodePage(magicNumber)); !errors.Is(err, pager.ErrUnsupportedFormat) {
+			t.Fatalf("Deserialize btree: page with magic number %s returned %v, expected %v", magicNumber, err, pager.ErrUnsupportedFormat)
+		}
+	}
+	if err := bt.deserialize(makeNodePage(constants.MagicNumberFree)); err == nil || errors.Is(err, pager.ErrUnsupportedFormat) {
+		t.Fatalf("Deserialize btree: free page returned %v, expected an invalid magic number", err)
+	}
+}
+
 func TestMakeTreeNodeEmptyPage(t *testing.T) {
 	buf := makeNodePage(constants.MagicNumberTree)
 	magicNumberStr := hex.EncodeToString(buf[:constants.MagicNumberSize])
@@ -55,23 +81,19 @@ func TestMakeTreeNodeEmptyPage(t *testing.T) {
 }
 
 func TestInsertIntoEmptyTree(t *testing.T) {
-	err := os.Remove("./my.db")
-	if err != nil {
-		t.Error(err)
-	}
-	bt := NewBtree()
-	defer bt.pager.File.Close()
+	bt := openTestTree(t, KeyModeUnique)
 	buf := make([]byte, 520)
 	copy(buf, "Hello World Insert")
 	bt.Insert(1, buf)
 
-	bt2 := NewBtree()
-	bt2.deserialize(bt.pager.ReadPage(0))
-	file, err := os.OpenFile(constants.DbFileName, os.O_RDWR|os.O_CREATE, 0755)
+	bt2 := &BTree{}
+	page, err := bt.pager.ReadPage(0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fstat, err := file.Stat()
+	bt2.deserialize(page)
+	bt.pager.Flush()
+	fstat, err := bt.pager.Fstat()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,29 +107,577 @@ func TestInsertIntoEmptyTree(t *testing.T) {
 	}
 
 	ln := initEmptyLeafNode()
-	ln.deserialize(bt.pager.ReadPage(1))
+	page, err = bt.pager.ReadPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.deserialize(page)
 	if ln.Cells[0].key != 1 || string(ln.Cells[0].data[:18]) != "Hello World Insert" {
 		t.Fatalf("BTree: Failed to insert data")
 	}
 }
 
 func TestInsertAndSplit(t *testing.T) {
-	os.Remove("my.db")
-	bt := NewBtree()
+	bt := openTestTree(t, KeyModeUnique)
 	buf := make([]byte, 520)
-	for i := 1; i <= 17; i++ {
+	for i := 1; i <= 21; i++ {
 		str := fmt.Sprintf("Hello World Insert %d", i)
 		copy(buf, str)
 		bt.Insert(uint32(i), buf)
-		bt.reload()
+		bt.loadTree()
 	}
 
 	buf = make([]byte, 520)
 	copy(buf, "Insert duplicate key 12")
 	bt.Insert(12, buf)
-	bt.reload()
+	bt.loadTree()
 
 	if bt.NumNode != 8 || bt.Root != 8 {
 		t.Errorf("Failed to insert and split correctly, found num node %d, expected %d; found root %d, expected %d", bt.NumNode, 8, bt.Root, 8)
 	}
 }
+
+// Open a pager over a new db file in the test's temp dir
+func openTestPager(t *testing.T) *pager.Pager {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "test.db"), os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	p, err := pager.Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Open a tree in a new db file in the test's temp dir
+func openTestTree(t *testing.T, mode KeyMode) *BTree {
+	bt, err := Open(openTestPager(t), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bt
+}
+
+func mustReadNode(t *testing.T, bt *BTree, page PageNum) node {
+	n, err := bt.readNode(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func mustDelete(t *testing.T, bt *BTree, k uint32) bool {
+	deleted, err := bt.Delete(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deleted
+}
+
+func mustSearch(t *testing.T, bt *BTree, k uint32) (bool, []byte) {
+	found, data, err := bt.Search(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found, data
+}
+
+func mustSearchAll(t *testing.T, bt *BTree, k uint32) [][]byte {
+	values, err := bt.SearchAll(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func insertRows(t *testing.T, bt *BTree, keys []int) {
+	buf := make([]byte, 520)
+	for _, k := range keys {
+		copy(buf, fmt.Sprintf("Hello World Insert %d", k))
+		bt.Insert(uint32(k), buf)
+	}
+}
+
+// walk the tree from root, checking key order, parent pointers and the leaf chain
+func verifyTree(t *testing.T, bt *BTree) []key {
+	if violations := bt.Check(); len(violations) > 0 {
+		t.Fatalf("tree check failed: %v", violations)
+	}
+
+	var leaves []PageNum
+	var walk func(page PageNum, parent PageNum, low, high *key) int
+	walk = func(page PageNum, parent PageNum, low, high *key) int {
+		n := mustReadNode(t, bt, page)
+		if n.header().Parent != parent {
+			t.Fatalf("node %d has parent %d, expected %d", page, n.header().Parent, parent)
+		}
+		count := 1
+		switch n := n.(type) {
+		case *LeafNode:
+			if parent != 0 && n.usedBytes() < minLeafBytes() {
+				t.Fatalf("leaf node %d underflow with %d bytes", page, n.usedBytes())
+			}
+			for i := 0; i < int(n.Header.NumCell); i++ {
+				k := n.Cells[i].key
+				if (low != nil && k < *low) || (high != nil && k >= *high) {
+					t.Fatalf("key %d out of range in leaf %d", k, page)
+				}
+			}
+			leaves = append(leaves, page)
+		case *InternalNode:
+			keys, children := n.keys(), n.children()
+			if parent != 0 && uint32(len(keys)) < minInternalNodeNumCell() {
+				t.Fatalf("internal node %d underflow with %d keys", page, len(keys))
+			}
+			for i, child := range children {
+				l, h := low, high
+				if i > 0 {
+					l = &keys[i-1]
+				}
+				if i < len(keys) {
+					h = &keys[i]
+				}
+				count += walk(child, page, l, h)
+			}
+		}
+		return count
+	}
+	count := walk(bt.Root, 0, nil, nil)
+	if uint32(count) != bt.NumNode {
+		t.Fatalf("found %d nodes, expected NumNode %d", count, bt.NumNode)
+	}
+
+	var keys []key
+	page := bt.First
+	for i, leaf := range leaves {
+		if page != leaf {
+			t.Fatalf("leaf %d in the Next chain is %d, expected %d", i, page, leaf)
+		}
+		ln := mustReadNode(t, bt, page).(*LeafNode)
+		for j := 0; j < int(ln.Header.NumCell); j++ {
+			if len(keys) > 0 && ln.Cells[j].key <= keys[len(keys)-1] {
+				t.Fatalf("keys out of order at leaf %d", page)
+			}
+			keys = append(keys, ln.Cells[j].key)
+		}
+		page = ln.Header.Next
+	}
+	if page != 0 {
+		t.Fatalf("the last leaf points to %d", page)
+	}
+	return keys
+}
+
+func TestDelete(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	if mustDelete(t, bt, 1) {
+		t.Fatal("Deleted key from an empty tree")
+	}
+
+	var keys []int
+	for i := 1; i <= 100; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+	verifyTree(t, bt)
+
+	// odd keys from the front, then even keys from the back
+	deleted := map[int]bool{}
+	for i := 1; i <= 100; i += 2 {
+		if !mustDelete(t, bt, uint32(i)) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+		deleted[i] = true
+		verifyTree(t, bt)
+	}
+	for i := 100; i > 50; i -= 2 {
+		if !mustDelete(t, bt, uint32(i)) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+		deleted[i] = true
+		verifyTree(t, bt)
+	}
+	if mustDelete(t, bt, 1) {
+		t.Fatal("Deleted key 1 twice")
+	}
+
+	for i := 1; i <= 100; i++ {
+		found, data := mustSearch(t, bt, uint32(i))
+		if found == deleted[i] {
+			t.Fatalf("Search key %d after delete: found %v", i, found)
+		}
+		if found && string(data[:len(fmt.Sprintf("Hello World Insert %d", i))]) != fmt.Sprintf("Hello World Insert %d", i) {
+			t.Fatalf("Wrong data for key %d", i)
+		}
+	}
+
+	for i := 2; i <= 50; i += 2 {
+		mustDelete(t, bt, uint32(i))
+	}
+	if keys := verifyTree(t, bt); len(keys) != 0 {
+		t.Fatalf("Tree is not empty after deleting all keys: %v", keys)
+	}
+	if bt.NumNode != 1 || bt.Root != bt.First {
+		t.Fatalf("Root didn't collapse to a single leaf, num node %d, root %d, first %d", bt.NumNode, bt.Root, bt.First)
+	}
+
+	// the tree still works after collapsing
+	insertRows(t, bt, []int{3, 1, 2})
+	if keys := verifyTree(t, bt); len(keys) != 3 {
+		t.Fatalf("Failed to insert after deleting all keys: %v", keys)
+	}
+}
+
+func TestDeleteRandomOrder(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	r := rand.New(rand.NewSource(1))
+	keys := r.Perm(300)
+	for i := range keys {
+		keys[i]++
+	}
+	insertRows(t, bt, keys)
+	verifyTree(t, bt)
+
+	r.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for n, k := range keys {
+		if !mustDelete(t, bt, uint32(k)) {
+			t.Fatalf("Failed to delete key %d", k)
+		}
+		if remaining := verifyTree(t, bt); len(remaining) != len(keys)-n-1 {
+			t.Fatalf("Found %d keys after deleting %d of %d", len(remaining), n+1, len(keys))
+		}
+	}
+}
+
+func TestInsertDuplicateKeyUnique(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	var keys []int
+	for i := 1; i <= 30; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+
+	buf := make([]byte, 520)
+	for _, k := range []uint32{1, 7, 14, 30} {
+		err := bt.Insert(k, buf)
+		if !errors.Is(err, ErrDuplicateKey) {
+			t.Fatalf("Insert duplicate key %d: found error %v, expected %v", k, err, ErrDuplicateKey)
+		}
+	}
+	if keys := verifyTree(t, bt); len(keys) != 30 {
+		t.Fatalf("Found %d keys after rejecting duplicates, expected %d", len(keys), 30)
+	}
+}
+
+func TestInsertDuplicateKeys(t *testing.T) {
+	bt := openTestTree(t, KeyModeDuplicate)
+
+	// a run of 25 equal keys spans several leaves
+	buf := make([]byte, 520)
+	for i := 1; i <= 25; i++ {
+		for _, k := range []uint32{10, 20, 30} {
+			copy(buf, fmt.Sprintf("key %d value %d", k, i))
+			if err := bt.Insert(k, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bt.loadTree()
+	if bt.KeyMode != KeyModeDuplicate {
+		t.Fatalf("Key mode is not saved in the tree page, found %d", bt.KeyMode)
+	}
+
+	for _, k := range []uint32{10, 20, 30} {
+		values := mustSearchAll(t, bt, k)
+		if len(values) != 25 {
+			t.Fatalf("Found %d values for key %d, expected %d", len(values), k, 25)
+		}
+		for i, v := range values {
+			expected := fmt.Sprintf("key %d value %d", k, i+1)
+			if string(v[:len(expected)]) != expected {
+				t.Fatalf("Wrong value %d for key %d: %s", i, k, v[:len(expected)])
+			}
+		}
+		found, data := mustSearch(t, bt, k)
+		if !found || string(data[:len(fmt.Sprintf("key %d value 1", k))]) != fmt.Sprintf("key %d value 1", k) {
+			t.Fatalf("Search key %d didn't return the first value", k)
+		}
+	}
+
+	count := 0
+	bt.Range(Bound{Key: 20, Inclusive: true}, Bound{Key: 20, Inclusive: true}, true, func(key uint32, data []byte) bool {
+		count++
+		return true
+	})
+	if count != 25 {
+		t.Fatalf("Reverse range over duplicate key found %d cells, expected %d", count, 25)
+	}
+
+	if !mustDelete(t, bt, 20) {
+		t.Fatal("Failed to delete duplicate key 20")
+	}
+	if values := mustSearchAll(t, bt, 20); len(values) != 0 {
+		t.Fatalf("Found %d values of key 20 after delete", len(values))
+	}
+	if len(mustSearchAll(t, bt, 10)) != 25 || len(mustSearchAll(t, bt, 30)) != 25 {
+		t.Fatal("Deleting key 20 removed other keys")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	var keys []int
+	for i := 1; i <= 30; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+	numNode := bt.NumNode
+
+	buf := make([]byte, 520)
+	copy(buf, "Replaced 15")
+	replaced, err := bt.Upsert(15, buf)
+	if err != nil || !replaced {
+		t.Fatalf("Upsert existing key 15: replaced %v, error %v", replaced, err)
+	}
+	buf = make([]byte, 520)
+	copy(buf, "Inserted 31")
+	replaced, err = bt.Upsert(31, buf)
+	if err != nil || replaced {
+		t.Fatalf("Upsert new key 31: replaced %v, error %v", replaced, err)
+	}
+
+	if found, data := mustSearch(t, bt, 15); !found || string(data[:11]) != "Replaced 15" {
+		t.Fatal("Upsert didn't overwrite key 15")
+	}
+	if found, data := mustSearch(t, bt, 31); !found || string(data[:11]) != "Inserted 31" {
+		t.Fatal("Upsert didn't insert key 31")
+	}
+	if keys := verifyTree(t, bt); len(keys) != 31 || bt.NumNode < numNode {
+		t.Fatalf("Found %d keys after upsert, expected %d", len(keys), 31)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	var keys []int
+	for i := 1; i <= 30; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+	numNode := bt.NumNode
+
+	buf := make([]byte, 520)
+	copy(buf, "Updated 20")
+	if err := bt.Update(20, buf); err != nil {
+		t.Fatal(err)
+	}
+	if found, data := mustSearch(t, bt, 20); !found || string(data[:10]) != "Updated 20" {
+		t.Fatal("Update didn't overwrite key 20")
+	}
+	if err := bt.Update(31, buf); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Update missing key 31: found error %v, expected %v", err, ErrKeyNotFound)
+	}
+	if keys := verifyTree(t, bt); len(keys) != 30 || bt.NumNode != numNode {
+		t.Fatalf("Update changed the tree, found %d keys and %d nodes", len(keys), bt.NumNode)
+	}
+	if err := bt.Update(20, make([]byte, MaxDataSize()+1)); !errors.Is(err, ErrDataTooLarge) {
+		t.Fatalf("Update with too large data: found error %v, expected %v", err, ErrDataTooLarge)
+	}
+
+	// shrinking cells merges leaves, growing them splits leaves
+	for _, k := range keys {
+		if err := bt.Update(uint32(k), []byte(fmt.Sprint(k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := verifyTree(t, bt); len(keys) != 30 || bt.NumNode != 1 {
+		t.Fatalf("Found %d keys and %d nodes after shrinking every cell, expected 30 keys in the root", len(keys), bt.NumNode)
+	}
+	for _, k := range keys {
+		if err := bt.Update(uint32(k), make([]byte, 520)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := verifyTree(t, bt); len(keys) != 30 || bt.NumNode < numNode {
+		t.Fatalf("Found %d keys and %d nodes after growing every cell, expected at least %d nodes", len(keys), bt.NumNode, numNode)
+	}
+}
+
+// Cells of random sizes split, borrow and merge by the bytes they take
+func TestVariableSizeCells(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[uint32][]byte)
+	randomData := func(k int) []byte {
+		data := make([]byte, rnd.Intn(int(MaxDataSize())+1))
+		copy(data, fmt.Sprint(k))
+		return data
+	}
+
+	for _, k := range rnd.Perm(500) {
+		data := randomData(k)
+		if err := bt.Insert(uint32(k), data); err != nil {
+			t.Fatal(err)
+		}
+		expected[uint32(k)] = data
+	}
+	verifyTree(t, bt)
+	for _, k := range rnd.Perm(500)[:200] {
+		data := randomData(k)
+		if err := bt.Update(uint32(k), data); err != nil {
+			t.Fatal(err)
+		}
+		expected[uint32(k)] = data
+	}
+	verifyTree(t, bt)
+	for _, k := range rnd.Perm(500)[:400] {
+		mustDelete(t, bt, uint32(k))
+		delete(expected, uint32(k))
+		verifyTree(t, bt)
+	}
+
+	if keys := verifyTree(t, bt); len(keys) != len(expected) {
+		t.Fatalf("Found %d keys, expected %d", len(keys), len(expected))
+	}
+	for k, data := range expected {
+		if found, value := mustSearch(t, bt, k); !found || !bytes.Equal(value, data) {
+			t.Fatalf("Key %d has %d bytes of data, expected %d", k, len(value), len(data))
+		}
+	}
+	if violations := bt.Check(); len(violations) > 0 {
+		t.Fatalf("Check found violations: %v", violations)
+	}
+}
+
+func TestPageErrorsReturned(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	keys := make([]int, 30)
+	for i := range keys {
+		keys[i] = i + 1
+	}
+	insertRows(t, bt, keys)
+	if err := bt.pager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file loses every page after the first leaf, the root is past its end
+	if err := bt.pager.File.Truncate(2 * int64(constants.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pager.Init(bt.pager.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := Open(p, KeyModeUnique)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := truncated.Search(5); !errors.Is(err, pager.ErrPageOutOfRange) {
+		t.Fatalf("Search on a truncated file returned %v, expected ErrPageOutOfRange", err)
+	}
+	if err := truncated.Insert(31, make([]byte, 520)); !errors.Is(err, pager.ErrPageOutOfRange) {
+		t.Fatalf("Insert on a truncated file returned %v, expected ErrPageOutOfRange", err)
+	}
+	if _, err := truncated.Delete(5); !errors.Is(err, pager.ErrPageOutOfRange) {
+		t.Fatalf("Delete on a truncated file returned %v, expected ErrPageOutOfRange", err)
+	}
+
+	// the scan reads the first leaf, then fails on the next one
+	c := truncated.FullScan()
+	for ; c.Valid(); c.Next() {
+	}
+	if !errors.Is(c.Err(), pager.ErrPageOutOfRange) {
+		t.Fatalf("Full scan on a truncated file stopped with %v, expected ErrPageOutOfRange", c.Err())
+	}
+}
+
+func TestRollbackRestoresTree(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	insertRows(t, bt, []int{1, 2, 3})
+	if err := bt.pager.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	root, first, numNode, numPages := bt.Root, bt.First, bt.NumNode, bt.pager.NumPages()
+
+	// splits allocate pages and move the root
+	keys := make([]int, 0, 200)
+	for k := 4; k < 204; k++ {
+		keys = append(keys, k)
+	}
+	insertRows(t, bt, keys)
+	if bt.Root == root {
+		t.Fatalf("root didn't move after %d inserts", len(keys))
+	}
+
+	bt.pager.Rollback()
+	if err := bt.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.Root != root || bt.First != first || bt.NumNode != numNode {
+		t.Fatalf("tree root %d, first %d, %d nodes after rollback, expected root %d, first %d, %d nodes",
+			bt.Root, bt.First, bt.NumNode, root, first, numNode)
+	}
+	if bt.pager.NumPages() != numPages {
+		t.Fatalf("%d pages after rollback, expected %d", bt.pager.NumPages(), numPages)
+	}
+	if found, _ := mustSearch(t, bt, 100); found {
+		t.Fatalf("key 100 inserted in the rolled back transaction was found")
+	}
+	if got := verifyTree(t, bt); len(got) != 3 {
+		t.Fatalf("%d keys after rollback, expected 3", len(got))
+	}
+}
+
+func TestOpenTree(t *testing.T) {
+	file := openTestTree(t, KeyModeUnique)
+	var saved [2]Header
+	trees := make([]*BTree, 2)
+	for i := range trees {
+		i := i
+		trees[i] = file.OpenTree(Header{KeyMode: KeyModeUnique}, func(header Header) error {
+			saved[i] = header
+			return nil
+		})
+	}
+
+	// the trees grow into each other's freed pages, sharing the file's freelist
+	keys := make([]int, 0, 100)
+	for k := 1; k <= 100; k++ {
+		keys = append(keys, k)
+	}
+	insertRows(t, trees[0], keys)
+	for _, k := range keys[:80] {
+		mustDelete(t, trees[0], uint32(k))
+	}
+	if file.NumFree == 0 {
+		t.Fatalf("no free page in the file after deleting from a tree")
+	}
+	numPages := file.pager.NumPages()
+	insertRows(t, trees[1], keys[:20])
+	if file.pager.NumPages() != numPages {
+		t.Fatalf("file grew from %d to %d pages while free pages were left", numPages, file.pager.NumPages())
+	}
+
+	for i, bt := range trees {
+		if saved[i] != bt.Header() {
+			t.Fatalf("tree %d saved header %+v, expected %+v", i, saved[i], bt.Header())
+		}
+		if got := verifyTree(t, bt); len(got) != 20 {
+			t.Fatalf("%d keys in tree %d, expected 20", len(got), i)
+		}
+	}
+	if violations := file.Check(trees...); len(violations) > 0 {
+		t.Fatalf("file check failed: %v", violations)
+	}
+	if violations := file.Check(trees[0]); !hasViolation(violations, trees[1].Root, "neither a node of the tree nor a free page") {
+		t.Fatalf("file check without tree 1 didn't report its root %d: %v", trees[1].Root, violations)
+	}
+}
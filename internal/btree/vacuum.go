@@ -0,0 +1,198 @@
+package btree
+
+import (
+	"fmt"
+
+	"github.com/tomial/go-db/internal/pager"
+)
+
+// A node of the compacted tree, with the smallest key of its subtree
+// which becomes the separator on its left in the parent
+type compactChild struct {
+	page  PageNum
+	first key
+}
+
+// Split count items into the fewest groups of at most size items,
+// spreading them evenly so every group but a single one is at least half full
+func groupSizes(count int, size int) []int {
+	groups := (count + size - 1) / size
+	sizes := make([]int, groups)
+	for i := range sizes {
+		sizes[i] = count / groups
+		if i < count%groups {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// Split cells of the byte sizes, in order, into the counts of cells of leaves
+// filled up to the node body. The last leaf takes cells from the one before it
+// when it's below the minimum, which stays above it as it couldn't take
+// the next cell.
+func leafGroups(cellSizes []uint32) []int {
+	var counts []int
+	var used []uint32
+	for _, size := range cellSizes {
+		last := len(counts) - 1
+		if last < 0 || used[last]+size > nodeBodySize() {
+			counts = append(counts, 0)
+			used = append(used, 0)
+			last++
+		}
+		counts[last]++
+		used[last] += size
+	}
+	for last := len(counts) - 1; last > 0 && used[last] < minLeafBytes(); {
+		moved := cellSizes[sumInts(counts[:last])-1]
+		counts[last-1]--
+		used[last-1] -= moved
+		counts[last]++
+		used[last] += moved
+	}
+	return counts
+}
+
+func sumInts(nums []int) int {
+	sum := 0
+	for _, n := range nums {
+		sum += n
+	}
+	return sum
+}
+
+// Write a compacted copy of the tree to dst, which must be empty.
+// The cells are packed densely into leaves on contiguous pages in key order,
+// right after the tree page, then every internal level follows with the root
+// on the last page. The copy has no free pages.
+func (bt *BTree) Compact(dst *pager.Pager) (*BTree, error) {
+	if dst.NumPages() != 0 {
+		return nil, fmt.Errorf("compacting tree: destination has %d pages, expected an empty file", dst.NumPages())
+	}
+	compact := &BTree{KeyMode: bt.KeyMode, pager: dst}
+	compact.file = compact
+	dst.Allocate() // tree page
+	if err := bt.compactTo(compact); err != nil {
+		return nil, err
+	}
+	return compact, compact.save()
+}
+
+// Write a compacted copy of the tree to the end of the file of dst, the copy
+// is opened like OpenTree with save storing its header. The pages are laid
+// out like Compact does, the freelist of dst isn't used.
+func (bt *BTree) CompactInto(dst *BTree, save func(Header) error) (*BTree, error) {
+	compact := dst.OpenTree(Header{KeyMode: bt.KeyMode}, save)
+	if err := bt.compactTo(compact); err != nil {
+		return nil, err
+	}
+	return compact, compact.save()
+}
+
+// Write the nodes of the compacted copy on new pages at the end of the file
+// and set the header of compact, which is an empty tree
+func (bt *BTree) compactTo(compact *BTree) error {
+	dst := compact.pager
+	var cellSizes []uint32
+	c := bt.FullScan()
+	for ; c.Valid(); c.Next() {
+		cellSizes = append(cellSizes, c.leaf.Cells[c.index].size())
+	}
+	if c.Err() != nil {
+		return c.Err()
+	}
+	if len(cellSizes) == 0 {
+		return nil
+	}
+
+	leafSizes := leafGroups(cellSizes)
+
+	// page numbers of every level are known upfront, so nodes are written once
+	levelSizes := [][]int{leafSizes}
+	for n := len(leafSizes); n > 1; {
+		sizes := groupSizes(n, int(maxInternalNodeNumCell())+1)
+		levelSizes = append(levelSizes, sizes)
+		n = len(sizes)
+	}
+	firstPages := make([]PageNum, len(levelSizes)+1)
+	firstPages[0] = PageNum(dst.NumPages())
+	for level, sizes := range levelSizes {
+		firstPages[level+1] = firstPages[level] + PageNum(len(sizes))
+	}
+	// parents of the nodes of a level, in order
+	parentsOf := func(level int) []PageNum {
+		if level+1 == len(levelSizes) {
+			return []PageNum{0}
+		}
+		var parents []PageNum
+		for i, size := range levelSizes[level+1] {
+			for j := 0; j < size; j++ {
+				parents = append(parents, firstPages[level+1]+PageNum(i))
+			}
+		}
+		return parents
+	}
+
+	children := make([]compactChild, 0, len(leafSizes))
+	parents := parentsOf(0)
+	c.First()
+	for i, size := range leafSizes {
+		ln := initEmptyLeafNode()
+		ln.btree = compact
+		ln.Header.Page = firstPages[0] + PageNum(i)
+		ln.Header.Parent = parents[i]
+		if ln.Header.Parent == 0 {
+			ln.Header.Typ = TypeRoot
+		}
+		if i+1 < len(leafSizes) {
+			ln.Header.Next = ln.Header.Page + 1
+		}
+		for j := 0; j < size && c.Valid(); j++ {
+			ln.insertCellAt(j, &leafCell{key: key(c.Key()), data: c.Value()})
+			c.Next()
+		}
+		if c.Err() != nil {
+			return c.Err()
+		}
+		if err := ln.save(); err != nil {
+			return err
+		}
+		children = append(children, compactChild{page: ln.Header.Page, first: ln.Cells[0].key})
+	}
+
+	for level := 1; level < len(levelSizes); level++ {
+		parents := parentsOf(level)
+		next := make([]compactChild, 0, len(levelSizes[level]))
+		for i, size := range levelSizes[level] {
+			in := initEmptyInternalNode()
+			in.btree = compact
+			in.Header.Page = firstPages[level] + PageNum(i)
+			in.Header.Parent = parents[i]
+			in.Header.Height = uint8(level)
+			if in.Header.Parent == 0 {
+				in.Header.Typ = TypeRoot
+			}
+			keys := make([]key, 0, size-1)
+			pages := make([]PageNum, 0, size)
+			for j, child := range children[:size] {
+				if j > 0 {
+					keys = append(keys, child.first)
+				}
+				pages = append(pages, child.page)
+			}
+			in.setEntries(keys, pages)
+			if err := in.save(); err != nil {
+				return err
+			}
+			next = append(next, compactChild{page: in.Header.Page, first: children[0].first})
+			children = children[size:]
+		}
+		children = next
+	}
+
+	compact.Root = children[0].page
+	compact.First = firstPages[0]
+	compact.NumNode = uint32(firstPages[len(levelSizes)] - firstPages[0])
+	return nil
+}
@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestGroupSizes(t *testing.T) {
+	cases := []struct {
+		count, size int
+		expected    []int
+	}{
+		{1, 6, []int{1}},
+		{6, 6, []int{6}},
+		{7, 6, []int{4, 3}},
+		{13, 6, []int{5, 4, 4}},
+		{5, 4, []int{3, 2}},
+	}
+	for _, c := range cases {
+		if sizes := groupSizes(c.count, c.size); !reflect.DeepEqual(sizes, c.expected) {
+			t.Errorf("groupSizes(%d, %d) = %v, expected %v", c.count, c.size, sizes, c.expected)
+		}
+	}
+}
+
+func TestLeafGroups(t *testing.T) {
+	repeat := func(size uint32, count int) []uint32 {
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			sizes[i] = size
+		}
+		return sizes
+	}
+	cases := []struct {
+		sizes    []uint32
+		expected []int
+	}{
+		{repeat(528, 1), []int{1}},
+		{repeat(528, 7), []int{7}},
+		{repeat(528, 8), []int{6, 2}}, // 1 cell is below a quarter of the body
+		{repeat(528, 16), []int{7, 7, 2}},
+		{repeat(13, 400), []int{313, 87}},
+		{append(repeat(1017, 4), 13), []int{3, 2}},
+	}
+	for _, c := range cases {
+		if counts := leafGroups(c.sizes); !reflect.DeepEqual(counts, c.expected) {
+			t.Errorf("leafGroups(%d x %d bytes ...) = %v, expected %v", len(c.sizes), c.sizes[0], counts, c.expected)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	keys := rand.Perm(300)
+	for i := range keys {
+		keys[i]++
+	}
+	insertRows(t, bt, keys)
+	for _, k := range keys[:200] {
+		mustDelete(t, bt, uint32(k))
+	}
+	expected := verifyTree(t, bt)
+
+	compact, err := bt.Compact(openTestPager(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := verifyTree(t, compact); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Compacted tree has keys %v, expected %v", found, expected)
+	}
+	for _, k := range keys[200:] {
+		if found, data := mustSearch(t, compact, uint32(k)); !found || string(data[:len("Hello World Insert")]) != "Hello World Insert" {
+			t.Fatalf("Key %d lost its data in the compacted tree", k)
+		}
+	}
+
+	// leaves on the pages after the tree page, in key order
+	for i, page := range leafChain(t, compact) {
+		if page != PageNum(i+1) {
+			t.Fatalf("Leaf %d of the Next chain is on page %d, expected %d", i, page, i+1)
+		}
+	}
+	if compact.NumFree != 0 || compact.pager.NumPages() != compact.NumNode+1 {
+		t.Fatalf("Compacted tree has %d nodes and %d free pages in %d pages", compact.NumNode, compact.NumFree, compact.pager.NumPages())
+	}
+	if compact.NumNode >= bt.NumNode+bt.NumFree {
+		t.Fatalf("Compacted tree has %d nodes, the original one %d nodes and %d free pages", compact.NumNode, bt.NumNode, bt.NumFree)
+	}
+
+	// the compacted tree keeps working
+	insertRows(t, compact, []int{1000, 1001, 1002})
+	mustDelete(t, compact, uint32(keys[250]))
+	verifyTree(t, compact)
+}
+
+func TestCompactDuplicateKeys(t *testing.T) {
+	bt := openTestTree(t, KeyModeDuplicate)
+	for i := 0; i < 20; i++ {
+		insertRows(t, bt, []int{10, 20, 30})
+	}
+	compact, err := bt.Compact(openTestPager(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violations := compact.Check(); len(violations) != 0 {
+		t.Fatalf("Check compacted tree: %v", violations)
+	}
+	if compact.KeyMode != KeyModeDuplicate {
+		t.Fatalf("Compacted tree has key mode %d, expected %d", compact.KeyMode, KeyModeDuplicate)
+	}
+	if values := mustSearchAll(t, compact, 20); len(values) != 20 {
+		t.Fatalf("Found %d cells with key 20 in the compacted tree, expected 20", len(values))
+	}
+}
+
+func TestCompactEmptyTree(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+	insertRows(t, bt, []int{1, 2, 3})
+	for k := uint32(1); k <= 3; k++ {
+		mustDelete(t, bt, k)
+	}
+	compact, err := bt.Compact(openTestPager(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violations := compact.Check(); len(violations) != 0 {
+		t.Fatalf("Check compacted tree: %v", violations)
+	}
+	if compact.Root != 0 || compact.pager.NumPages() != 1 {
+		t.Fatalf("Compacted empty tree has root %d in %d pages", compact.Root, compact.pager.NumPages())
+	}
+
+	if _, err := bt.Compact(bt.pager); err == nil {
+		t.Fatal("Compact into a non-empty file returned no error")
+	}
+}
+
+func TestCompactInto(t *testing.T) {
+	file := openTestTree(t, KeyModeUnique)
+	trees := make([]*BTree, 2)
+	for i := range trees {
+		trees[i] = file.OpenTree(Header{KeyMode: KeyModeUnique}, func(Header) error { return nil })
+		insertRows(t, trees[i], rand.Perm(100)[:60+20*i])
+	}
+
+	// every tree of the file is compacted after the previous one
+	dst := openTestTree(t, KeyModeUnique)
+	compacts := make([]*BTree, len(trees))
+	for i, bt := range trees {
+		var saved Header
+		compact, err := bt.CompactInto(dst, func(header Header) error {
+			saved = header
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved != compact.Header() {
+			t.Fatalf("Compacted tree %d saved header %+v, expected %+v", i, saved, compact.Header())
+		}
+		if found, expected := verifyTree(t, compact), verifyTree(t, bt); !reflect.DeepEqual(found, expected) {
+			t.Fatalf("Compacted tree %d has keys %v, expected %v", i, found, expected)
+		}
+		compacts[i] = compact
+	}
+	if violations := dst.Check(compacts...); len(violations) != 0 {
+		t.Fatalf("Check compacted file: %v", violations)
+	}
+	if numNode := compacts[0].NumNode + compacts[1].NumNode; dst.pager.NumPages() != numNode+1 || dst.NumFree != 0 {
+		t.Fatalf("Compacted file has %d pages and %d free pages for %d nodes", dst.pager.NumPages(), dst.NumFree, numNode)
+	}
+}
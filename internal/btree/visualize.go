@@ -0,0 +1,164 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+func (t NodeType) String() string {
+	switch t {
+	case TypeInternal:
+		return "internal"
+	case TypeLeaf:
+		return "leaf"
+	case TypeRoot:
+		return "root"
+	default:
+		return "invalid"
+	}
+}
+
+// Draw the whole tree from the db file as indented text, e.g.
+//
+//	tree: root 3, first 1, 3 nodes, 0 free pages
+//	└── [3] internal (root) cells 1, parent 0 | 4
+//	    ├── [1] leaf cells 3, parent 3, next 2 | 1 2 3
+//	    └── [2] leaf cells 4, parent 3, next 0 | 4 5 6 7
+func (bt *BTree) Visualize(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "tree: root %d, first %d, %d nodes, %d free pages\n", bt.Root, bt.First, bt.NumNode, bt.file.NumFree)
+	if err != nil || bt.NumNode == 0 {
+		return err
+	}
+	return bt.visualizeNode(w, bt.Root, "", true, map[PageNum]bool{})
+}
+
+func (bt *BTree) visualizeNode(w io.Writer, page PageNum, indent string, last bool, visited map[PageNum]bool) error {
+	branch, childIndent := "├── ", indent+"│   "
+	if last {
+		branch, childIndent = "└── ", indent+"    "
+	}
+
+	if visited[page] {
+		_, err := fmt.Fprintf(w, "%s%s[%d] visited already, the tree has a cycle\n", indent, branch, page)
+		return err
+	}
+	visited[page] = true
+
+	n, err := bt.readNode(page)
+	if err != nil {
+		_, err := fmt.Fprintf(w, "%s%s[%d] invalid page -- %s\n", indent, branch, page, err)
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s%s%s\n", indent, branch, bt.describeNode(n))
+	if err != nil {
+		return err
+	}
+
+	in, ok := n.(*InternalNode)
+	if !ok {
+		return nil
+	}
+	children := in.children()
+	for i, child := range children {
+		err := bt.visualizeNode(w, child, childIndent, i == len(children)-1, visited)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// One line summary of a node: page, type, NumCell, Parent, Next, free bytes and keys
+func (bt *BTree) describeNode(n node) string {
+	h := n.header()
+	ln, isLeaf := n.(*LeafNode)
+	typ := "internal"
+	if isLeaf {
+		typ = "leaf"
+	}
+	if h.Page == bt.Root {
+		typ += " (root)"
+	}
+
+	desc := fmt.Sprintf("[%d] %s cells %d, parent %d", h.Page, typ, h.NumCell, h.Parent)
+	if isLeaf {
+		desc += fmt.Sprintf(", next %d, free %dB", h.Next, ln.freeBytes())
+	}
+	return desc + " | " + strings.Join(nodeKeys(n), " ")
+}
+
+func nodeKeys(n node) []string {
+	var keys []string
+	switch n := n.(type) {
+	case *LeafNode:
+		for i := 0; i < int(n.Header.NumCell); i++ {
+			keys = append(keys, fmt.Sprint(n.Cells[i].key))
+		}
+	case *InternalNode:
+		for _, k := range n.keys() {
+			keys = append(keys, fmt.Sprint(k))
+		}
+	}
+	return keys
+}
+
+// Export the tree as a Graphviz DOT graph, render it with e.g. dot -Tsvg.
+// Internal nodes link to their children through ports between the keys,
+// leaves link to their Next leaf with dashed edges.
+func (bt *BTree) VisualizeDot(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph btree {\n")
+	b.WriteString("\tnode [shape=record, fontname=monospace];\n")
+	fmt.Fprintf(&b, "\tlabel=\"root %d, first %d, %d nodes\";\n", bt.Root, bt.First, bt.NumNode)
+
+	var leaves []*LeafNode
+	visited := map[PageNum]bool{}
+	queue := []PageNum{}
+	if bt.NumNode > 0 {
+		queue = append(queue, bt.Root)
+	}
+	for len(queue) > 0 {
+		page := queue[0]
+		queue = queue[1:]
+		if visited[page] {
+			continue
+		}
+		visited[page] = true
+
+		n, err := bt.readNode(page)
+		if err != nil {
+			fmt.Fprintf(&b, "\tn%d [label=\"page %d | invalid\", color=red];\n", page, page)
+			continue
+		}
+		h := n.header()
+		switch n := n.(type) {
+		case *LeafNode:
+			leaves = append(leaves, n)
+			fmt.Fprintf(&b, "\tn%d [label=\"{page %d leaf, parent %d, next %d|{%s}}\"];\n",
+				page, page, h.Parent, h.Next, strings.Join(nodeKeys(n), "|"))
+		case *InternalNode:
+			ports := []string{"<c0>"}
+			for i, k := range n.keys() {
+				ports = append(ports, fmt.Sprint(k), fmt.Sprintf("<c%d>", i+1))
+			}
+			fmt.Fprintf(&b, "\tn%d [label=\"{page %d internal, parent %d|{%s}}\"];\n",
+				page, page, h.Parent, strings.Join(ports, "|"))
+			for i, child := range n.children() {
+				fmt.Fprintf(&b, "\tn%d:c%d -> n%d;\n", page, i, child)
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	for _, ln := range leaves {
+		if ln.Header.Next != 0 {
+			fmt.Fprintf(&b, "\tn%d -> n%d [style=dashed, constraint=false];\n", ln.Header.Page, ln.Header.Next)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,61 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVisualize(t *testing.T) {
+	bt := openTestTree(t, KeyModeUnique)
+
+	var keys []int
+	for i := 1; i <= 20; i++ {
+		keys = append(keys, i)
+	}
+	insertRows(t, bt, keys)
+
+	var buf bytes.Buffer
+	err := bt.Visualize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != int(bt.NumNode)+1 {
+		t.Fatalf("Visualize: found %d lines, expected a header and %d nodes:\n%s", len(lines), bt.NumNode, buf.String())
+	}
+	if !strings.HasPrefix(lines[1], fmt.Sprintf("└── [%d] internal (root)", bt.Root)) {
+		t.Fatalf("Visualize: the first node is not the root: %s", lines[1])
+	}
+	if !strings.Contains(buf.String(), "| 17 18 19 20") {
+		t.Fatalf("Visualize: keys of the last leaf not found:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	err = bt.VisualizeDot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph btree {") {
+		t.Fatalf("VisualizeDot: not a digraph:\n%s", dot)
+	}
+	// every node but the root has a parent edge, every leaf but the last one has a next edge
+	children := strings.Count(dot, ":c")
+	if children != int(bt.NumNode)-1 {
+		t.Fatalf("VisualizeDot: found %d child edges, expected %d", children, bt.NumNode-1)
+	}
+	if next := strings.Count(dot, "style=dashed"); next != len(leafChain(t, bt))-1 {
+		t.Fatalf("VisualizeDot: found %d next edges", next)
+	}
+}
+
+func leafChain(t *testing.T, bt *BTree) []PageNum {
+	var leaves []PageNum
+	for page := bt.First; page != 0; {
+		leaves = append(leaves, page)
+		page = mustReadNode(t, bt, page).header().Next
+	}
+	return leaves
+}
@@ -2,8 +2,19 @@ package constants
 
 const PageSize uint32 = 4096
 const MagicNumberSize uint32 = 2
-const MagicNumberTree = "abc0"
-const MagicNumberLeaf = "abc1"
-const MagicNumberInternal = "abc2"
+const PageChecksumSize uint32 = 4 // CRC32C of the page, right after the magic number
+const PageHeaderSize = MagicNumberSize + PageChecksumSize
+
+// Every change of the layout of the pages gets new magic numbers, so a file
+// of an older format is told apart from a corrupt one
+const MagicNumberTree = "abc4"
+const MagicNumberLeaf = "abc5"
+const MagicNumberInternal = "abc6"
+const MagicNumberFree = "abc7"
+
+// Magic numbers of the pages of the older formats, which can't be read anymore:
+// the pages without a checksum, then the checksummed pages of fixed-size leaf cells
+var LegacyMagicNumbers = []string{"abc0", "abc1", "abc2", "abc3"}
+
 const DbFileName string = "./my.db"
 const BTreeKeySize = 4 // key == uint32
@@ -0,0 +1,36 @@
+package datatype
+
+import "fmt"
+
+// Type of a table column
+type Type uint8
+
+const (
+	TypeUint Type = iota
+	TypeInt
+	TypeString
+	TypeInvalid
+)
+
+var typeNames = map[Type]string{
+	TypeUint:   "uint",
+	TypeInt:    "int",
+	TypeString: "string",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "invalid"
+}
+
+// The type with the name used in create table, e.g. string
+func ParseType(name string) (Type, error) {
+	for t, typeName := range typeNames {
+		if typeName == name {
+			return t, nil
+		}
+	}
+	return TypeInvalid, fmt.Errorf("unknown type %s, expected uint, int or string", name)
+}
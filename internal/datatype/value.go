@@ -0,0 +1,64 @@
+package datatype
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A value of a column, the field of its type is set
+type Value struct {
+	Type Type
+	Uint uint64
+	Int  int64
+	Str  string
+}
+
+func UintValue(v uint64) Value {
+	return Value{Type: TypeUint, Uint: v}
+}
+
+func IntValue(v int64) Value {
+	return Value{Type: TypeInt, Int: v}
+}
+
+func StringValue(v string) Value {
+	return Value{Type: TypeString, Str: v}
+}
+
+// The zero value of the type, 0 or an empty string
+func ZeroValue(t Type) Value {
+	return Value{Type: t}
+}
+
+func (v Value) String() string {
+	switch v.Type {
+	case TypeUint:
+		return strconv.FormatUint(v.Uint, 10)
+	case TypeInt:
+		return strconv.FormatInt(v.Int, 10)
+	case TypeString:
+		return v.Str
+	}
+	return "invalid"
+}
+
+// The value of the type written as s in a statement
+func ParseValue(t Type, s string) (Value, error) {
+	switch t {
+	case TypeUint:
+		num, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid value %s of type uint", s)
+		}
+		return UintValue(num), nil
+	case TypeInt:
+		num, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid value %s of type int", s)
+		}
+		return IntValue(num), nil
+	case TypeString:
+		return StringValue(s), nil
+	}
+	return Value{}, fmt.Errorf("invalid type %d", t)
+}
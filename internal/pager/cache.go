@@ -0,0 +1,90 @@
+package pager
+
+import "container/list"
+
+// Pages kept in memory by a pager created with Init
+const DefaultCacheSize = 256
+
+// A page held in the buffer pool
+type frame struct {
+	page  uint32
+	data  []byte
+	dirty bool          // changed since it was read or flushed
+	pins  int           // pinned frames are never evicted
+	elem  *list.Element // position in the LRU list
+}
+
+// Counters of the buffer pool, shown by .stats
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Flushes   uint64 // dirty pages written to the file
+}
+
+// Fraction of the page reads served from memory
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// Buffer pool of pages with LRU eviction, the front of the list is the most
+// recently used frame
+type cache struct {
+	size    int
+	frames  map[uint32]*frame
+	lru     *list.List
+	stats   Stats
+	noSteal bool // dirty frames are never evicted, they wait for the commit
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:   size,
+		frames: make(map[uint32]*frame),
+		lru:    list.New(),
+	}
+}
+
+// Returns the frame of the page if it's in memory, and marks it as used
+func (c *cache) get(page uint32) *frame {
+	f, ok := c.frames[page]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(f.elem)
+	return f
+}
+
+// Add a frame for the page, the caller fills in its data
+func (c *cache) add(page uint32, data []byte) *frame {
+	f := &frame{page: page, data: data}
+	f.elem = c.lru.PushFront(f)
+	c.frames[page] = f
+	return f
+}
+
+// Least recently used frame that isn't pinned, nil if every frame is pinned
+// or the pool isn't full yet. The pool grows over its size meanwhile.
+func (c *cache) victim() *frame {
+	if len(c.frames) < c.size {
+		return nil
+	}
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		f := e.Value.(*frame)
+		if f.pins == 0 && !(c.noSteal && f.dirty) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (c *cache) remove(f *frame) {
+	c.lru.Remove(f.elem)
+	delete(c.frames, f.page)
+}
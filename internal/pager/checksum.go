@@ -0,0 +1,75 @@
+package pager
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Every page stores a CRC32C of its content right after its magic number,
+// written by WritePage and verified when the page is read from the disk,
+// so a torn write or a flipped bit is reported instead of being parsed
+// +-------+----------+--------------------+
+// | magic | checksum |      content       |
+// |  2B   |    4B    |                    |
+// +-------+----------+--------------------+
+
+var ErrPageCorrupt = errors.New("corrupt page")
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum of the page, without the checksum field itself
+func pageChecksum(data []byte) uint32 {
+	checksum := crc32.Update(0, castagnoli, data[:constants.MagicNumberSize])
+	return crc32.Update(checksum, castagnoli, data[constants.PageHeaderSize:])
+}
+
+func setPageChecksum(data []byte) {
+	binary.LittleEndian.PutUint32(data[constants.MagicNumberSize:], pageChecksum(data))
+}
+
+func verifyPageChecksum(page uint32, data []byte) error {
+	stored := binary.LittleEndian.Uint32(data[constants.MagicNumberSize:])
+	if computed := pageChecksum(data); stored != computed {
+		return fmt.Errorf("%w: page %d has checksum %08x, expected %08x", ErrPageCorrupt, page, stored, computed)
+	}
+	return nil
+}
+
+// Verify the page read from the disk. A page of an older format has no
+// checksum, or not at the same place, so its magic number is checked first
+// and it's reported as a page of another format rather than a corrupt one.
+func verifyPage(page uint32, data []byte) error {
+	if err := verifyPageFormat(page, data); err != nil {
+		return err
+	}
+	return verifyPageChecksum(page, data)
+}
+
+func verifyPageFormat(page uint32, data []byte) error {
+	magicNumber := hex.EncodeToString(data[:constants.MagicNumberSize])
+	if slices.Contains(constants.LegacyMagicNumbers, magicNumber) {
+		return fmt.Errorf("%w: page %d has the magic number %s of a file written by an older version", ErrUnsupportedFormat, page, magicNumber)
+	}
+	return nil
+}
+
+// Check the format of the file from its first page on the disk, before a log
+// is attached to the pager, so a file of an older format is left as it was.
+// An empty file has the current format.
+func (p *Pager) CheckFormat() error {
+	if p.numPages == 0 {
+		return nil
+	}
+	magicNumber := make([]byte, constants.MagicNumberSize)
+	if _, err := p.File.ReadAt(magicNumber, 0); err != nil {
+		return fmt.Errorf("%w: reading page 0: %w", ErrIO, err)
+	}
+	return verifyPageFormat(0, magicNumber)
+}
@@ -0,0 +1,182 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Rollback journal next to the db file. Before a page of the db file is
+// overwritten for the first time since the last flush, its original image
+// is appended to the journal and the journal is synced. The flush deletes
+// the journal once the db file is synced, a journal found on open belongs to
+// a flush interrupted by a crash and is rolled back into the db file.
+//
+// +--------+-------+-------+-----+
+// | header | entry | entry | ... | -> journal file
+// +--------+-------+-------+-----+
+//
+// header: magic 4B, amount of pages of the db file before the flush 4B
+// entry:  page 4B, checksum 4B, original page image 4KB
+
+const journalMagic uint32 = 0x67646a6e // "gdjn"
+const journalHeaderSize = 8
+const journalEntryHeaderSize = 8
+const journalEntrySize = journalEntryHeaderSize + int64(constants.PageSize)
+
+type journal struct {
+	path      string
+	file      *os.File // nil until a page is overwritten since the last flush
+	numPages  uint32   // pages of the db file when the journal was started
+	entries   int64
+	journaled map[uint32]bool
+}
+
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+// Create the journal, recording the size of the db file
+func (j *journal) begin(db *os.File) error {
+	fstat, err := db.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: reading database file stat %s: %w", ErrIO, db.Name(), err)
+	}
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("%w: creating journal %s: %w", ErrIO, j.path, err)
+	}
+	header := make([]byte, journalHeaderSize)
+	binary.LittleEndian.PutUint32(header, journalMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(fstat.Size()/int64(constants.PageSize)))
+	if _, err := file.WriteAt(header, 0); err != nil {
+		file.Close()
+		return fmt.Errorf("%w: writing journal header: %w", ErrIO, err)
+	}
+	// pages appended to the db file are truncated by a rollback even when
+	// no original page was journaled
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("%w: syncing journal: %w", ErrIO, err)
+	}
+	j.file = file
+	j.numPages = uint32(fstat.Size() / int64(constants.PageSize))
+	j.entries = 0
+	j.journaled = make(map[uint32]bool)
+	return nil
+}
+
+// Copy the original image of the pages about to be overwritten in the db
+// file to the journal and sync it. Pages already journaled since the last
+// flush and pages past the end of the original file are skipped.
+func (j *journal) save(db *os.File, pages ...uint32) error {
+	if j.file == nil {
+		if err := j.begin(db); err != nil {
+			return err
+		}
+	}
+	entry := make([]byte, journalEntrySize)
+	saved := 0
+	for _, page := range pages {
+		if page >= j.numPages || j.journaled[page] {
+			continue
+		}
+		data := entry[journalEntryHeaderSize:]
+		if _, err := db.ReadAt(data, int64(page)*int64(constants.PageSize)); err != nil && err != io.EOF {
+			return fmt.Errorf("%w: reading page %d to journal: %w", ErrIO, page, err)
+		}
+		binary.LittleEndian.PutUint32(entry, page)
+		binary.LittleEndian.PutUint32(entry[4:], journalChecksum(page, data))
+		offset := journalHeaderSize + j.entries*journalEntrySize
+		if _, err := j.file.WriteAt(entry, offset); err != nil {
+			return fmt.Errorf("%w: writing page %d to journal: %w", ErrIO, page, err)
+		}
+		j.entries++
+		j.journaled[page] = true
+		saved++
+	}
+	if saved == 0 {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("%w: syncing journal: %w", ErrIO, err)
+	}
+	return nil
+}
+
+func journalChecksum(page uint32, data []byte) uint32 {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, page)
+	return crc32.Update(crc32.ChecksumIEEE(buf), crc32.IEEETable, data)
+}
+
+// The db file is synced, the original pages aren't needed anymore
+func (j *journal) commit() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	j.journaled = nil
+	if err != nil {
+		return fmt.Errorf("%w: closing journal: %w", ErrIO, err)
+	}
+	if err := os.Remove(j.path); err != nil {
+		return fmt.Errorf("%w: removing journal: %w", ErrIO, err)
+	}
+	return nil
+}
+
+// Roll back a hot journal left by a crash: write the original pages back
+// to the db file, truncate it to its original size and remove the journal.
+// An entry with a wrong checksum was torn while being journaled, its page
+// wasn't overwritten yet, so the journal is only read up to it.
+func (j *journal) rollback(db *os.File) error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: opening journal %s: %w", ErrIO, j.path, err)
+	}
+	defer file.Close()
+
+	header := make([]byte, journalHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	// a journal without a valid header was created before any page was written
+	if n == journalHeaderSize && binary.LittleEndian.Uint32(header) == journalMagic {
+		numPages := binary.LittleEndian.Uint32(header[4:])
+		entry := make([]byte, journalEntrySize)
+		for offset := int64(journalHeaderSize); ; offset += journalEntrySize {
+			n, err := file.ReadAt(entry, offset)
+			if n < len(entry) {
+				break
+			}
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("%w: reading journal: %w", ErrIO, err)
+			}
+			page := binary.LittleEndian.Uint32(entry)
+			data := entry[journalEntryHeaderSize:]
+			if binary.LittleEndian.Uint32(entry[4:]) != journalChecksum(page, data) {
+				break
+			}
+			if _, err := db.WriteAt(data, int64(page)*int64(constants.PageSize)); err != nil {
+				return fmt.Errorf("%w: rolling back page %d: %w", ErrIO, page, err)
+			}
+		}
+		if err := db.Truncate(int64(numPages) * int64(constants.PageSize)); err != nil {
+			return fmt.Errorf("%w: truncating database file: %w", ErrIO, err)
+		}
+		if err := db.Sync(); err != nil {
+			return fmt.Errorf("%w: syncing database file: %w", ErrIO, err)
+		}
+	}
+	if err := os.Remove(j.path); err != nil {
+		return fmt.Errorf("%w: removing journal: %w", ErrIO, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package pager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Attach a rollback journal next to the pager's file
+func openTestJournal(t *testing.T, pager *Pager) {
+	if err := pager.OpenJournal(pager.File.Name() + "-journal"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Overwrite both test pages with a page starting with b, and append page 2
+func overwriteTestPages(t *testing.T, pager *Pager, b byte) {
+	buf := make([]byte, constants.PageSize)
+	buf[0] = b
+	for page := uint32(0); page < 3; page++ {
+		if err := pager.WritePage(page, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalDeletedOnFlush(t *testing.T) {
+	pager := openTestPager(t)
+	openTestJournal(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+	overwriteTestPages(t, pager, 0x11)
+	mustFlush(t, pager)
+
+	if _, err := os.Stat(pager.journal.path); !os.IsNotExist(err) {
+		t.Fatalf("Journal: journal still exists after flush, %v", err)
+	}
+	if data := mustReadPage(t, pager, 1); data[0] != 0x11 {
+		t.Fatalf("Journal: page 1 after flush %x", data[:2])
+	}
+}
+
+func TestJournalRollback(t *testing.T) {
+	pager := openTestPager(t)
+	openTestJournal(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// crash after the pages are written but before the journal is deleted
+	overwriteTestPages(t, pager, 0x11)
+	dirty := []*frame{pager.cache.frames[0], pager.cache.frames[1], pager.cache.frames[2]}
+	if err := pager.journal.save(pager.File, 0, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range dirty {
+		if err := pager.writeBack(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.OpenFile(pager.File.Name(), os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reopened, err := Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openTestJournal(t, reopened)
+
+	if reopened.NumPages() != 2 {
+		t.Fatalf("Journal: %d pages after rollback, expected the appended page truncated", reopened.NumPages())
+	}
+	if data := mustReadPage(t, reopened, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("Journal: page 0 after rollback %x", data[:2])
+	}
+	if data := mustReadPage(t, reopened, 1); data[0] != 0xEF || data[1] != 0xFE {
+		t.Fatalf("Journal: page 1 after rollback %x", data[:2])
+	}
+	if _, err := os.Stat(reopened.journal.path); !os.IsNotExist(err) {
+		t.Fatalf("Journal: hot journal still exists after rollback, %v", err)
+	}
+}
+
+func TestJournalEvictedPage(t *testing.T) {
+	pager := openTestPager(t)
+	openTestJournal(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// evicting a dirty page overwrites it in the file, it's journaled first
+	pager.cache = newCache(1)
+	buf := make([]byte, constants.PageSize)
+	buf[0] = 0x11
+	if err := pager.WritePage(0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := pager.WritePage(1, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !pager.journal.journaled[0] {
+		t.Fatalf("Journal: page 0 evicted without being journaled")
+	}
+	fstat, err := os.Stat(pager.journal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstat.Size() != journalHeaderSize+journalEntrySize {
+		t.Fatalf("Journal: journal size %d, expected a single entry", fstat.Size())
+	}
+}
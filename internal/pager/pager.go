@@ -1,63 +1,389 @@
 package pager
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"sort"
 
 	"github.com/tomial/go-db/internal/constants"
 )
 
+var ErrPageOutOfRange = errors.New("page out of range")
+var ErrShortRead = errors.New("short read")
+var ErrIO = errors.New("i/o error")
+
+// Pager reads and writes the pages of the db file through a buffer pool,
+// written pages stay in memory until Flush or until they're evicted.
+// With a write-ahead log, Flush commits the written pages to the log and
+// they're never evicted before. With a rollback journal, the original pages
+// are journaled before they're overwritten in the file.
+// In a transaction, written pages are never evicted either, so Rollback can
+// discard them.
 type Pager struct {
-	File *os.File
+	File     *os.File
+	numPages uint32 // pages in file, including the allocated ones not written yet
+	cache    *cache
+	wal      *wal
+	journal  *journal
+	tx       bool
+	txPages  uint32 // numPages when the transaction began
+}
+
+func Init(file *os.File) (*Pager, error) {
+	return InitWithCacheSize(file, DefaultCacheSize)
+}
+
+// Init a pager keeping at most size pages in memory, pinned pages aside
+func InitWithCacheSize(file *os.File, size int) (*Pager, error) {
+	p := &Pager{File: file, cache: newCache(size)}
+	fstat, err := p.Fstat()
+	if err != nil {
+		return nil, err
+	}
+	p.numPages = uint32(fstat.Size()) / constants.PageSize
+	return p, nil
+}
+
+// Write the pages through a write-ahead log at path from now on.
+// The commits found in an existing log are replayed into the db file first.
+func (p *Pager) OpenWAL(path string) error {
+	w, err := openWAL(path)
+	if err != nil {
+		return err
+	}
+	if err := w.checkpoint(p.File); err != nil {
+		w.file.Close()
+		return err
+	}
+	fstat, err := p.Fstat()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	if pages := uint32(fstat.Size()) / constants.PageSize; pages > p.numPages {
+		p.numPages = pages
+	}
+	p.wal = w
+	p.cache.noSteal = true
+	return nil
+}
+
+// Copy the pages committed to the write-ahead log back to the db file
+func (p *Pager) Checkpoint() error {
+	if p.wal == nil {
+		return nil
+	}
+	return p.wal.checkpoint(p.File)
+}
+
+// Checkpoint and remove the write-ahead log, pages are written to the
+// db file directly from now on
+func (p *Pager) CloseWAL() error {
+	if p.wal == nil {
+		return nil
+	}
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	if err := p.Checkpoint(); err != nil {
+		return err
+	}
+	w := p.wal
+	p.wal = nil
+	p.cache.noSteal = p.tx
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("%w: closing wal: %w", ErrIO, err)
+	}
+	if err := os.Remove(w.file.Name()); err != nil {
+		return fmt.Errorf("%w: removing wal: %w", ErrIO, err)
+	}
+	return nil
+}
+
+// Journal the original pages at path before they're overwritten from now on.
+// A journal left by a crash is rolled back into the db file first, so it
+// must be called before any page is read.
+func (p *Pager) OpenJournal(path string) error {
+	j := newJournal(path)
+	if err := j.rollback(p.File); err != nil {
+		return err
+	}
+	fstat, err := p.Fstat()
+	if err != nil {
+		return err
+	}
+	p.numPages = uint32(fstat.Size()) / constants.PageSize
+	p.journal = j
+	return nil
+}
+
+// Flush, then write the pages to the db file directly from now on
+func (p *Pager) CloseJournal() error {
+	if p.journal == nil {
+		return nil
+	}
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	p.journal = nil
+	return nil
+}
+
+// Keep the pages written from now on in memory until Commit or Rollback.
+// The pages written before are flushed first.
+func (p *Pager) Begin() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	p.tx = true
+	p.txPages = p.numPages
+	p.cache.noSteal = true
+	return nil
+}
+
+// Flush the pages written in the transaction and end it
+func (p *Pager) Commit() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	p.endTx()
+	return nil
+}
+
+// Discard the pages written in the transaction and end it, the next reads
+// return the pages as they were when it began
+func (p *Pager) Rollback() {
+	if !p.tx {
+		return
+	}
+	for _, f := range p.cache.frames {
+		if f.dirty {
+			p.cache.remove(f)
+		}
+	}
+	p.numPages = p.txPages
+	p.endTx()
+}
+
+func (p *Pager) InTransaction() bool {
+	return p.tx
 }
 
-func Init(file *os.File) *Pager {
-	return &Pager{File: file}
+func (p *Pager) endTx() {
+	p.tx = false
+	p.cache.noSteal = p.wal != nil
 }
 
-func (p *Pager) Fstat() os.FileInfo {
+// Amount of pages in the file, including the allocated ones not written yet
+func (p *Pager) NumPages() uint32 {
+	return p.numPages
+}
+
+// Reserve a new page at the end of the file, the caller writes it later
+func (p *Pager) Allocate() uint32 {
+	page := p.numPages
+	p.numPages++
+	return page
+}
+
+func (p *Pager) Fstat() (os.FileInfo, error) {
 	fstat, err := p.File.Stat()
 	if err != nil {
-		log.Fatalf("Pager: failed to read database file stat %s -- %s", constants.DbFileName, err)
+		return nil, fmt.Errorf("%w: reading database file stat %s: %w", ErrIO, p.File.Name(), err)
 	}
-	return fstat
+	return fstat, nil
 }
 
-func (p *Pager) WritePage(page uint32, data []byte) {
+// Store the page in the buffer pool and mark it dirty, it's written to the
+// file by Flush. The data is copied with its checksum set, the caller can reuse it.
+// The page must be in the file, allocated, or the one right after the last page.
+func (p *Pager) WritePage(page uint32, data []byte) error {
 
 	pageSize := len(data)
 
 	if pageSize != int(constants.PageSize) {
-		log.Fatalf("Pager: writing page, invalid page size: %d\n", pageSize)
+		return fmt.Errorf("writing page %d: invalid page size %d, expected %d", page, pageSize, constants.PageSize)
 	}
 
-	offset := io.SeekStart + page*constants.PageSize
-	n, err := p.File.WriteAt(data, int64(offset))
-	if n != int(constants.PageSize) {
-		log.Fatalf("Pager: failed to write all page data, wrote %d\n", n)
+	if page > p.numPages {
+		return fmt.Errorf("%w: writing page %d, the file has %d pages", ErrPageOutOfRange, page, p.numPages)
 	}
 
-	if err != nil {
-		log.Fatalf("Pager: failed to write page: %s\n", err.Error())
+	f, ok := p.cache.frames[page]
+	if !ok {
+		buf, err := p.frameBuffer()
+		if err != nil {
+			return err
+		}
+		f = p.cache.add(page, buf)
+	}
+	copy(f.data, data)
+	setPageChecksum(f.data)
+	f.dirty = true
+	p.cache.lru.MoveToFront(f.elem)
+
+	if page >= p.numPages {
+		p.numPages = page + 1
 	}
 
+	return nil
 }
 
-// page start from 1, page 0 is for tree struct
-func (p *Pager) ReadPage(page uint32) []byte {
-	pageBuf := make([]byte, constants.PageSize)
+// page start from 1, page 0 is for tree struct.
+// The returned buffer belongs to the buffer pool, it must not be modified
+// and it's only valid until the next call to the pager unless the page is pinned.
+func (p *Pager) ReadPage(page uint32) ([]byte, error) {
+	if page >= p.numPages {
+		return nil, fmt.Errorf("%w: reading page %d, the file has %d pages", ErrPageOutOfRange, page, p.numPages)
+	}
+
+	if f := p.cache.get(page); f != nil {
+		return f.data, nil
+	}
+
+	pageBuf, err := p.frameBuffer()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.wal != nil {
+		found, err := p.wal.readPage(page, pageBuf)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if err := verifyPage(page, pageBuf); err != nil {
+				return nil, err
+			}
+			return p.cache.add(page, pageBuf).data, nil
+		}
+	}
 
 	offset := io.SeekStart + page*constants.PageSize
 	n, err := p.File.ReadAt(pageBuf, int64(offset))
 
+	// a page allocated but never written is past the end of the file
 	if n != int(constants.PageSize) {
-		log.Fatalf("Pager: read incomplete page sized %d at page %d\n", n, page)
+		return nil, fmt.Errorf("%w: read %d bytes of page %d", ErrShortRead, n, page)
 	}
 
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%w: reading page %d: %w", ErrIO, page, err)
+	}
+
+	if err := verifyPage(page, pageBuf); err != nil {
+		return nil, err
+	}
+
+	return p.cache.add(page, pageBuf).data, nil
+}
+
+// Read the page and keep it in memory until Unpin, the buffer stays valid
+// meanwhile
+func (p *Pager) Pin(page uint32) ([]byte, error) {
+	data, err := p.ReadPage(page)
 	if err != nil {
-		log.Fatalf("Pager: failed to seek page %d offset -- %s\n", page, err.Error())
+		return nil, err
 	}
+	p.cache.frames[page].pins++
+	return data, nil
+}
+
+func (p *Pager) Unpin(page uint32) {
+	f, ok := p.cache.frames[page]
+	if !ok || f.pins == 0 {
+		panic(fmt.Sprintf("pager: unpinning page %d which isn't pinned", page))
+	}
+	f.pins--
+}
+
+// Write every dirty page to the file in page order and sync it.
+// With a write-ahead log, the pages are committed to the log in a single
+// write, and checkpointed once the log is long enough.
+func (p *Pager) Flush() error {
+	dirty := make([]*frame, 0)
+	for _, f := range p.cache.frames {
+		if f.dirty {
+			dirty = append(dirty, f)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].page < dirty[j].page })
+
+	if p.wal != nil {
+		if len(dirty) == 0 {
+			return nil
+		}
+		if err := p.wal.commit(dirty, p.numPages); err != nil {
+			return err
+		}
+		for _, f := range dirty {
+			f.dirty = false
+		}
+		p.cache.stats.Flushes += uint64(len(dirty))
+		if p.wal.frames >= walCheckpointFrames {
+			return p.Checkpoint()
+		}
+		return nil
+	}
+
+	if p.journal != nil && len(dirty) > 0 {
+		pages := make([]uint32, len(dirty))
+		for i, f := range dirty {
+			pages[i] = f.page
+		}
+		if err := p.journal.save(p.File, pages...); err != nil {
+			return err
+		}
+	}
+	for _, f := range dirty {
+		if err := p.writeBack(f); err != nil {
+			return err
+		}
+	}
+	if err := p.File.Sync(); err != nil {
+		return fmt.Errorf("%w: syncing database file: %w", ErrIO, err)
+	}
+	if p.journal != nil {
+		return p.journal.commit()
+	}
+	return nil
+}
 
-	return pageBuf
+func (p *Pager) Stats() Stats {
+	return p.cache.stats
+}
+
+// Buffer for a new frame, taken from the least recently used frame if the
+// pool is full, which is written to the file first if it's dirty
+func (p *Pager) frameBuffer() ([]byte, error) {
+	victim := p.cache.victim()
+	if victim == nil {
+		return make([]byte, constants.PageSize), nil
+	}
+	if victim.dirty {
+		if p.journal != nil {
+			if err := p.journal.save(p.File, victim.page); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.writeBack(victim); err != nil {
+			return nil, err
+		}
+	}
+	p.cache.remove(victim)
+	p.cache.stats.Evictions++
+	return victim.data, nil
+}
+
+func (p *Pager) writeBack(f *frame) error {
+	offset := io.SeekStart + f.page*constants.PageSize
+	_, err := p.File.WriteAt(f.data, int64(offset))
+	if err != nil {
+		return fmt.Errorf("%w: writing page %d: %w", ErrIO, f.page, err)
+	}
+	f.dirty = false
+	p.cache.stats.Flushes++
+	return nil
 }
@@ -1,21 +1,75 @@
 package pager
 
 import (
+	"encoding/binary"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/tomial/go-db/internal/constants"
 )
 
-func TestWritePage(t *testing.T) {
-	file, _ := os.OpenFile(constants.DbFileName, os.O_RDWR|os.O_CREATE, 0755)
-	pager := Init(file)
+// Open a pager over a new file in the test's temp dir
+func openTestPager(t *testing.T) *Pager {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "test.db"), os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	pager, err := Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pager
+}
 
+// Write page 0 starting with 0xABCD and page 1 starting with 0xEFFE
+func writeTestPages(t *testing.T, pager *Pager) {
 	buf := make([]byte, constants.PageSize)
 	buf[0] = 0xAB
 	buf[1] = 0xCD
-	pager.WritePage(0, buf)
+	if err := pager.WritePage(0, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	buf = make([]byte, constants.PageSize)
+	buf[0] = 0xEF
+	buf[1] = 0xFE
+	if err := pager.WritePage(1, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustReadPage(t *testing.T, pager *Pager, page uint32) []byte {
+	data, err := pager.ReadPage(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func mustFlush(t *testing.T, pager *Pager) {
+	if err := pager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+
+	// written pages stay in memory until flushed
+	fstat, err := pager.Fstat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstat.Size() != 0 {
+		t.Fatalf("Pager: page written to the file before flush, file size %d", fstat.Size())
+	}
+	mustFlush(t, pager)
 
 	verifyBuf := make([]byte, 2)
 	pager.File.ReadAt(verifyBuf, io.SeekStart)
@@ -23,10 +77,6 @@ func TestWritePage(t *testing.T) {
 		t.Fatalf("Pager: failed to write certain page")
 	}
 
-	buf = make([]byte, constants.PageSize)
-	buf[0] = 0xEF
-	buf[1] = 0xFE
-	pager.WritePage(1, buf)
 	verifyBuf = make([]byte, 2)
 	pager.File.ReadAt(verifyBuf, int64(constants.PageSize))
 	if verifyBuf[0] != 0xEF || verifyBuf[1] != 0xFE {
@@ -35,15 +85,228 @@ func TestWritePage(t *testing.T) {
 }
 
 func TestReadPage(t *testing.T) {
-	file, _ := os.OpenFile(constants.DbFileName, os.O_RDWR|os.O_CREATE, 0755)
-	pager := Init(file)
-	data := pager.ReadPage(0)
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+
+	data := mustReadPage(t, pager, 0)
 	if data[0] != 0xAB || data[1] != 0xCD {
 		t.Fatalf("Pager: failed to read certain page")
 	}
 
-	data = pager.ReadPage(1)
+	data = mustReadPage(t, pager, 1)
 	if data[0] != 0xEF || data[1] != 0xFE {
 		t.Fatalf("Pager: failed to read certain page")
 	}
 }
+
+func TestReadPageCache(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	reopened, err := InitWithCacheSize(pager.File, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustReadPage(t, reopened, 0)
+	mustReadPage(t, reopened, 1)
+	mustReadPage(t, reopened, 0)
+	mustReadPage(t, reopened, 0)
+	stats := reopened.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("Pager: found %d hits and %d misses, expected 2 and 2", stats.Hits, stats.Misses)
+	}
+	if stats.HitRatio() != 0.5 {
+		t.Fatalf("Pager: found hit ratio %f, expected 0.5", stats.HitRatio())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	pager := openTestPager(t)
+	pager.cache.size = 2
+	writeTestPages(t, pager)
+
+	// page 0 is the least recently used, writing page 2 evicts it to the file
+	buf := make([]byte, constants.PageSize)
+	buf[0] = 0x12
+	if err := pager.WritePage(2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pager.cache.frames[0]; ok {
+		t.Fatalf("Pager: least recently used page 0 not evicted")
+	}
+	if pager.Stats().Evictions != 1 || pager.Stats().Flushes != 1 {
+		t.Fatalf("Pager: found %d evictions and %d pages written, expected 1 and 1", pager.Stats().Evictions, pager.Stats().Flushes)
+	}
+	verifyBuf := make([]byte, 2)
+	pager.File.ReadAt(verifyBuf, io.SeekStart)
+	if verifyBuf[0] != 0xAB || verifyBuf[1] != 0xCD {
+		t.Fatalf("Pager: dirty page 0 not written back when evicted")
+	}
+
+	data := mustReadPage(t, pager, 0)
+	if data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("Pager: failed to read evicted page")
+	}
+}
+
+func TestPinnedPageNotEvicted(t *testing.T) {
+	pager := openTestPager(t)
+	pager.cache.size = 2
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	data, err := pager.Pin(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for page := uint32(1); page < 4; page++ {
+		if err := pager.WritePage(page, make([]byte, constants.PageSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := pager.cache.frames[0]; !ok {
+		t.Fatalf("Pager: pinned page 0 evicted")
+	}
+	if data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("Pager: pinned page buffer changed")
+	}
+
+	pager.Unpin(0)
+	if err := pager.WritePage(4, make([]byte, constants.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pager.cache.frames[0]; ok {
+		t.Fatalf("Pager: unpinned page 0 not evicted")
+	}
+}
+
+func TestPageErrors(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	if _, err := pager.ReadPage(2); !errors.Is(err, ErrPageOutOfRange) {
+		t.Fatalf("Pager: reading past the last page returned %v, expected ErrPageOutOfRange", err)
+	}
+	if err := pager.WritePage(3, make([]byte, constants.PageSize)); !errors.Is(err, ErrPageOutOfRange) {
+		t.Fatalf("Pager: writing after a gap returned %v, expected ErrPageOutOfRange", err)
+	}
+	if err := pager.WritePage(1, make([]byte, 10)); err == nil {
+		t.Fatalf("Pager: writing a page of invalid size returned no error")
+	}
+
+	// allocated but never written, the file ends before it
+	page := pager.Allocate()
+	if _, err := pager.ReadPage(page); !errors.Is(err, ErrShortRead) {
+		t.Fatalf("Pager: reading an unwritten page returned %v, expected ErrShortRead", err)
+	}
+
+	pager.File.Close()
+	reopened, err := InitWithCacheSize(pager.File, 2)
+	if !errors.Is(err, ErrIO) || reopened != nil {
+		t.Fatalf("Pager: init on a closed file returned %v, expected ErrIO", err)
+	}
+}
+
+func TestPageChecksum(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// a bit flipped on the disk is caught when the page is read again
+	if _, err := pager.File.WriteAt([]byte{0xFF}, int64(constants.PageSize)+100); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Init(pager.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := mustReadPage(t, reopened, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("Pager: page 0 read %x", data[:2])
+	}
+	_, err = reopened.ReadPage(1)
+	if !errors.Is(err, ErrPageCorrupt) || !strings.Contains(err.Error(), "page 1 ") {
+		t.Fatalf("Pager: reading a corrupt page returned %v, expected ErrPageCorrupt naming page 1", err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+	if err := pager.Begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// dirty pages of a transaction stay in memory even when the pool is full
+	pager.cache.size = 1
+	buf := make([]byte, constants.PageSize)
+	buf[0] = 0x11
+	for page := uint32(0); page < 3; page++ {
+		if err := pager.WritePage(page, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fstat, err := pager.Fstat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstat.Size() != 2*int64(constants.PageSize) {
+		t.Fatalf("Pager: page of the transaction written to the file, file size %d", fstat.Size())
+	}
+
+	pager.Rollback()
+	if pager.NumPages() != 2 {
+		t.Fatalf("Pager: %d pages after rollback, expected 2", pager.NumPages())
+	}
+	if data := mustReadPage(t, pager, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("Pager: page 0 after rollback %x", data[:2])
+	}
+
+	if err := pager.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pager.WritePage(1, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := pager.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	pager.Rollback() // no transaction, nothing to discard
+	if data := mustReadPage(t, pager, 1); data[0] != 0x11 {
+		t.Fatalf("Pager: page 1 after commit %x", data[:2])
+	}
+}
+
+// Pages of the older formats are reported as such, not as corrupt pages
+func TestLegacyPageFormat(t *testing.T) {
+	pager := openTestPager(t)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// page 0 as the first format wrote it: the tree fields right after the
+	// magic number, without a checksum
+	page := make([]byte, constants.PageSize)
+	page[0], page[1] = 0xAB, 0xC0
+	binary.LittleEndian.PutUint32(page[2:], 1)
+	if _, err := pager.File.WriteAt(page, 0); err != nil {
+		t.Fatal(err)
+	}
+	// a free page of the checksummed format of fixed-size leaf cells
+	page = make([]byte, constants.PageSize)
+	page[0], page[1] = 0xAB, 0xC3
+	setPageChecksum(page)
+	if _, err := pager.File.WriteAt(page, int64(constants.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Init(pager.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range []uint32{0, 1} {
+		if _, err := reopened.ReadPage(page); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Fatalf("Pager: reading page %d of an older format returned %v, expected ErrUnsupportedFormat", page, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Write-ahead log next to the db file. Flush appends the dirty pages to the
+// log instead of overwriting them in the db file, the last frame of a flush
+// is its commit record and the log is synced after it. Committed pages are
+// copied back to the db file by a checkpoint, the log is replayed on open so
+// a commit interrupted before its checkpoint isn't lost.
+//
+// +--------+-------+-------+-----+
+// | header | frame | frame | ... | -> wal file
+// +--------+-------+-------+-----+
+//
+// header: magic 4B, salt 4B, the salt changes every time the log restarts
+// frame:  page 4B, commit 4B, salt 4B, checksum 4B, page image 4KB
+//         commit is the amount of pages of the db after the commit for the
+//         commit record, 0 for the other frames
+
+const walMagic uint32 = 0x67646277 // "gdbw"
+const walHeaderSize = 8
+const walFrameHeaderSize = 16
+const walFrameSize = walFrameHeaderSize + int64(constants.PageSize)
+
+// Checkpoint once the log holds this many frames
+const walCheckpointFrames = 1000
+
+var ErrWALCorrupt = errors.New("corrupt wal")
+
+type wal struct {
+	file   *os.File
+	salt   uint32
+	frames int64            // frames in the log
+	index  map[uint32]int64 // page -> offset of its latest committed image
+}
+
+// Open or create the log at path and read its committed frames
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("%w: opening wal %s: %w", ErrIO, path, err)
+	}
+	w := &wal{file: file, index: make(map[uint32]int64)}
+	if err := w.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Index the frames of every complete commit. A log without a valid header
+// holds no commit, the frames after the last commit record were never
+// committed, and a frame with a wrong checksum was torn by a crash, the log
+// is only read up to it.
+func (w *wal) replay() error {
+	header := make([]byte, walHeaderSize)
+	n, err := w.file.ReadAt(header, 0)
+	if n < walHeaderSize || binary.LittleEndian.Uint32(header) != walMagic {
+		return w.reset(0)
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%w: reading wal header: %w", ErrIO, err)
+	}
+	w.salt = binary.LittleEndian.Uint32(header[4:])
+
+	pending := make(map[uint32]int64)
+	buf := make([]byte, walFrameSize)
+	for frame := int64(0); ; frame++ {
+		offset := walHeaderSize + frame*walFrameSize
+		n, err := w.file.ReadAt(buf, offset)
+		if n < len(buf) {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%w: reading wal frame %d: %w", ErrIO, frame, err)
+		}
+		page, commit, ok := w.decodeFrame(buf)
+		if !ok {
+			break
+		}
+		pending[page] = offset + walFrameHeaderSize
+		if commit != 0 {
+			for page, offset := range pending {
+				w.index[page] = offset
+			}
+			pending = make(map[uint32]int64)
+			w.frames = frame + 1
+		}
+	}
+	return nil
+}
+
+func (w *wal) encodeFrame(buf []byte, page uint32, commit uint32, data []byte) {
+	binary.LittleEndian.PutUint32(buf[0:], page)
+	binary.LittleEndian.PutUint32(buf[4:], commit)
+	binary.LittleEndian.PutUint32(buf[8:], w.salt)
+	copy(buf[walFrameHeaderSize:], data)
+	checksum := crc32.ChecksumIEEE(buf[:12])
+	checksum = crc32.Update(checksum, crc32.IEEETable, data)
+	binary.LittleEndian.PutUint32(buf[12:], checksum)
+}
+
+// Returns the page and commit fields of the frame, false if the frame
+// belongs to an older log or its checksum doesn't match
+func (w *wal) decodeFrame(buf []byte) (page uint32, commit uint32, ok bool) {
+	page = binary.LittleEndian.Uint32(buf[0:])
+	commit = binary.LittleEndian.Uint32(buf[4:])
+	if binary.LittleEndian.Uint32(buf[8:]) != w.salt {
+		return 0, 0, false
+	}
+	checksum := crc32.ChecksumIEEE(buf[:12])
+	checksum = crc32.Update(checksum, crc32.IEEETable, buf[walFrameHeaderSize:])
+	return page, commit, checksum == binary.LittleEndian.Uint32(buf[12:])
+}
+
+// Append the frames and their commit record, then sync the log.
+// numPages is the size of the db after the commit.
+func (w *wal) commit(frames []*frame, numPages uint32) error {
+	buf := make([]byte, int64(len(frames))*walFrameSize)
+	start := walHeaderSize + w.frames*walFrameSize
+	for i, f := range frames {
+		var commit uint32
+		if i == len(frames)-1 {
+			commit = numPages
+		}
+		w.encodeFrame(buf[int64(i)*walFrameSize:], f.page, commit, f.data)
+	}
+	if _, err := w.file.WriteAt(buf, start); err != nil {
+		return fmt.Errorf("%w: writing wal frames: %w", ErrIO, err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("%w: syncing wal: %w", ErrIO, err)
+	}
+	for i, f := range frames {
+		w.index[f.page] = start + int64(i)*walFrameSize + walFrameHeaderSize
+	}
+	w.frames += int64(len(frames))
+	return nil
+}
+
+// Read the latest committed image of the page into buf, false if the page
+// isn't in the log
+func (w *wal) readPage(page uint32, buf []byte) (bool, error) {
+	offset, ok := w.index[page]
+	if !ok {
+		return false, nil
+	}
+	n, err := w.file.ReadAt(buf, offset)
+	if n != len(buf) {
+		return true, fmt.Errorf("%w: %w: read %d bytes of page %d from the wal", ErrWALCorrupt, ErrShortRead, n, page)
+	}
+	if err != nil && err != io.EOF {
+		return true, fmt.Errorf("%w: reading page %d from the wal: %w", ErrIO, page, err)
+	}
+	return true, nil
+}
+
+// Copy the committed pages to the db file in page order and sync it,
+// then restart the log
+func (w *wal) checkpoint(db *os.File) error {
+	if len(w.index) == 0 {
+		return nil
+	}
+	pages := make([]uint32, 0, len(w.index))
+	for page := range w.index {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	buf := make([]byte, constants.PageSize)
+	for _, page := range pages {
+		if _, err := w.readPage(page, buf); err != nil {
+			return err
+		}
+		if _, err := db.WriteAt(buf, int64(page)*int64(constants.PageSize)); err != nil {
+			return fmt.Errorf("%w: checkpointing page %d: %w", ErrIO, page, err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		return fmt.Errorf("%w: syncing database file: %w", ErrIO, err)
+	}
+	return w.reset(w.salt + 1)
+}
+
+// Empty the log, frames written with the old salt are ignored from now on
+func (w *wal) reset(salt uint32) error {
+	w.salt = salt
+	w.frames = 0
+	w.index = make(map[uint32]int64)
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header, walMagic)
+	binary.LittleEndian.PutUint32(header[4:], salt)
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("%w: truncating wal: %w", ErrIO, err)
+	}
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("%w: writing wal header: %w", ErrIO, err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("%w: syncing wal: %w", ErrIO, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package pager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tomial/go-db/internal/constants"
+)
+
+// Attach a write-ahead log next to the pager's file
+func openTestWAL(t *testing.T, pager *Pager) {
+	if err := pager.OpenWAL(pager.File.Name() + "-wal"); err != nil {
+		t.Fatal(err)
+	}
+	w := pager.wal
+	t.Cleanup(func() { w.file.Close() })
+}
+
+// Open another pager over the same file, as a new run after a crash would
+func reopenTestPager(t *testing.T, pager *Pager) *Pager {
+	file, err := os.OpenFile(pager.File.Name(), os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	reopened, err := Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openTestWAL(t, reopened)
+	return reopened
+}
+
+func fileSize(t *testing.T, file *os.File) int64 {
+	fstat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fstat.Size()
+}
+
+func TestWALCommit(t *testing.T) {
+	pager := openTestPager(t)
+	openTestWAL(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// committed pages go to the log, not to the db file
+	if size := fileSize(t, pager.File); size != 0 {
+		t.Fatalf("WAL: pages written to the db file before checkpoint, file size %d", size)
+	}
+	if size := fileSize(t, pager.wal.file); size != walHeaderSize+2*walFrameSize {
+		t.Fatalf("WAL: log size %d, expected 2 frames", size)
+	}
+
+	// evicted pages are read back from the log
+	pager.cache = newCache(DefaultCacheSize)
+	pager.cache.noSteal = true
+	if data := mustReadPage(t, pager, 1); data[0] != 0xEF || data[1] != 0xFE {
+		t.Fatalf("WAL: page 1 read from the log %x", data[:2])
+	}
+
+	if err := pager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, pager.File); size != 2*int64(constants.PageSize) {
+		t.Fatalf("WAL: db file size %d after checkpoint", size)
+	}
+	if size := fileSize(t, pager.wal.file); size != walHeaderSize {
+		t.Fatalf("WAL: log size %d after checkpoint, expected an empty log", size)
+	}
+	if data := mustReadPage(t, pager, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("WAL: page 0 read after checkpoint %x", data[:2])
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	pager := openTestPager(t)
+	openTestWAL(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// crash before the checkpoint, the next open replays the commit
+	reopened := reopenTestPager(t, pager)
+	if reopened.NumPages() != 2 {
+		t.Fatalf("WAL: %d pages after replay, expected 2", reopened.NumPages())
+	}
+	if data := mustReadPage(t, reopened, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("WAL: page 0 after replay %x", data[:2])
+	}
+	if data := mustReadPage(t, reopened, 1); data[0] != 0xEF || data[1] != 0xFE {
+		t.Fatalf("WAL: page 1 after replay %x", data[:2])
+	}
+}
+
+func TestWALIgnoresUncommittedFrames(t *testing.T) {
+	pager := openTestPager(t)
+	openTestWAL(t, pager)
+	writeTestPages(t, pager)
+	mustFlush(t, pager)
+
+	// a second commit of both pages, torn by a crash in its commit record
+	buf := make([]byte, constants.PageSize)
+	buf[0] = 0x11
+	for page := uint32(0); page < 2; page++ {
+		if err := pager.WritePage(page, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustFlush(t, pager)
+	torn := walHeaderSize + 3*walFrameSize + walFrameHeaderSize + 100
+	if _, err := pager.wal.file.WriteAt([]byte{0xFF}, torn); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := reopenTestPager(t, pager)
+	if data := mustReadPage(t, reopened, 0); data[0] != 0xAB || data[1] != 0xCD {
+		t.Fatalf("WAL: page 0 of the torn commit was replayed %x", data[:2])
+	}
+	if data := mustReadPage(t, reopened, 1); data[0] != 0xEF || data[1] != 0xFE {
+		t.Fatalf("WAL: page 1 of the torn commit was replayed %x", data[:2])
+	}
+}
+
+func TestWALDirtyPageNotEvicted(t *testing.T) {
+	pager := openTestPager(t)
+	openTestWAL(t, pager)
+	pager.cache.size = 1
+	writeTestPages(t, pager)
+
+	// the pool grows instead of writing an uncommitted page to the db file
+	if size := fileSize(t, pager.File); size != 0 {
+		t.Fatalf("WAL: dirty page evicted to the db file, file size %d", size)
+	}
+	if len(pager.cache.frames) != 2 {
+		t.Fatalf("WAL: %d frames in the pool, expected 2", len(pager.cache.frames))
+	}
+}
+
+func TestCloseWAL(t *testing.T) {
+	pager := openTestPager(t)
+	openTestWAL(t, pager)
+	writeTestPages(t, pager)
+	path := pager.wal.file.Name()
+	if err := pager.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := fileSize(t, pager.File); size != 2*int64(constants.PageSize) {
+		t.Fatalf("WAL: db file size %d after closing the log", size)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("WAL: log still exists after closing it, %v", err)
+	}
+}
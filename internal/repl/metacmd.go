@@ -3,6 +3,8 @@ package repl
 import (
 	"log"
 	"os"
+
+	"github.com/tomial/go-db/internal/storage"
 )
 
 type MetaCommandType int
@@ -11,6 +13,12 @@ type MetaCommandResult int
 const (
 	MetaCmdTypeExit MetaCommandType = iota
 	MetaCmdHelp
+	MetaCmdBTree
+	MetaCmdCheck
+	MetaCmdOpen
+	MetaCmdStats
+	MetaCmdVacuum
+	MetaCmdTables
 	MetaCmdTypeUnrecognized
 )
 
@@ -23,6 +31,7 @@ const (
 
 type metaCommand struct {
 	str      string
+	args     []string
 	typ      MetaCommandType
 	result   MetaCommandResult
 	callback func()
@@ -31,23 +40,183 @@ type metaCommand struct {
 func (m *metaCommand) printHelp() {
 	var prompt = `
 	commands:
-	- insert [id] [username] [email]: insert new row [id username email]
-	- select [id]: select the row with [id]
+	- create table [name] ([column] [type], ...): create a table, [type] is uint, int or string,
+	  the first column is the primary key and must be uint
+	- drop table [name]: delete a table with its rows
+	- alter table [name] add column [column] [type] default [value]: add a column to a table,
+	  existing rows get [value], or 0 or an empty string without default
+	- insert into [table] values ([value], ...): insert a new row into [table] (also upsert into)
+	- select * from [table] [id|range] [desc]: select rows of [table], like select on table User
+	- insert [id] [username] [email]: insert new row [id username email] into table User
+	- upsert [id] [username] [email]: insert new row, or replace the row with [id] (alias: replace)
+	- update [id] set [column]=[value], ...: update columns of the row with [id]
+	- select [id]: select the row with [id], or every row in id order without [id]
+	- select [range] [desc]: select the rows in [range] in id order, reverse order with desc
+	  [range] can be: 1000..2000, 1000.., ..2000, [1000,2000), (1000,2000],
+	  where id between 1000 and 2000, where id > 1000 and id <= 2000
+	- delete [id]: delete the row with [id]
+	- .btree [table]: print the whole tree of [table] from the db file, table User by default
+	- .btree [table] dot [file]: export the tree as a Graphviz DOT graph to [file], or print it
+	- .tables: list the tables of the db file with their columns and the root, first leaf and node count of their tree
+	- .check: verify the structure of every table and of the file, report every violation found
+	- begin: start a transaction, the following statements are written to the db file all together by commit
+	- commit: write the changes of the transaction to the db file
+	- rollback: discard the changes of the transaction
+	- vacuum, .vacuum: rebuild the db file without the space left by deleted rows
+	- .stats: print the hit/miss counters of the page cache
+	- .open [path] [journal_mode=delete|wal|off]: close the current database and open the one at [path],
+	  journal_mode picks how a crash is recovered from, wal by default
 	- .help: print help
 	- .exit: quit
 	`
 	log.Println(prompt)
 }
 
+func (m *metaCommand) printTree() {
+	name := "User"
+	if len(m.args) > 0 && m.args[0] != "dot" {
+		name = m.args[0]
+		m.args = m.args[1:]
+	}
+	t := db.Table(name)
+	if t == nil {
+		log.Printf("%s: %s\n", storage.ErrNoSuchTable, name)
+		m.result = MetaCmdResultFailed
+		return
+	}
+
+	if len(m.args) == 0 {
+		err := t.BTree.Visualize(os.Stdout)
+		if err != nil {
+			log.Printf("Failed to visualize tree: %s\n", err)
+			m.result = MetaCmdResultFailed
+		}
+		return
+	}
+
+	if m.args[0] != "dot" || len(m.args) > 2 {
+		log.Println("Usage: .btree [table] or .btree [table] dot [file]")
+		m.result = MetaCmdResultFailed
+		return
+	}
+	out := os.Stdout
+	if len(m.args) == 2 {
+		file, err := os.Create(m.args[1])
+		if err != nil {
+			log.Printf("Failed to create DOT file: %s\n", err)
+			m.result = MetaCmdResultFailed
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+	err := t.BTree.VisualizeDot(out)
+	if err != nil {
+		log.Printf("Failed to export tree: %s\n", err)
+		m.result = MetaCmdResultFailed
+		return
+	}
+	if out != os.Stdout {
+		log.Printf("Exported tree to %s\n", m.args[1])
+	}
+}
+
+func (m *metaCommand) checkTree() {
+	if !check(db) {
+		m.result = MetaCmdResultFailed
+	}
+}
+
+// Verify every table of the database at path, print every violation found.
+// Returns true if the file is sound, false if it's missing.
+func Check(path string, options storage.Options) bool {
+	// opening a missing file would create an empty database, which is sound
+	if _, err := os.Stat(path); err != nil {
+		log.Println(err)
+		return false
+	}
+	db, err := storage.Open(path, options)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer db.Close()
+	return check(db)
+}
+
+func check(db *storage.DB) bool {
+	violations := db.Check()
+	for _, v := range violations {
+		log.Println(v)
+	}
+	if len(violations) > 0 {
+		log.Printf("check: %d violations found in %s\n", len(violations), db.Path)
+		return false
+	}
+	for _, t := range db.Tables() {
+		log.Printf("check: table %s ok, %d nodes\n", t.String(), t.BTree.NumNode)
+	}
+	log.Printf("check: %s ok, %d free pages\n", db.Path, db.NumFree())
+	return true
+}
+
+func (m *metaCommand) printTables() {
+	tables := db.Tables()
+	for _, t := range tables {
+		log.Printf("table %s (%s): root %d, first leaf %d, %d nodes\n",
+			t.String(), t.Schema(), t.BTree.Root, t.BTree.First, t.BTree.NumNode)
+	}
+	log.Printf("%d tables in %s\n", len(tables), db.Path)
+}
+
+func (m *metaCommand) printStats() {
+	stats := db.Stats()
+	log.Printf("cache: %d hits, %d misses, hit ratio %.2f%%\n", stats.Hits, stats.Misses, stats.HitRatio()*100)
+	log.Printf("cache: %d evictions, %d pages written\n", stats.Evictions, stats.Flushes)
+}
+
+func (m *metaCommand) vacuum() {
+	if err := vacuumDatabase(); err != nil {
+		log.Printf("Failed to vacuum: %s\n", err)
+		m.result = MetaCmdResultFailed
+	}
+}
+
+func (m *metaCommand) open() {
+	if len(m.args) < 1 {
+		log.Println("Usage: .open [path] [journal_mode=delete|wal|off]")
+		m.result = MetaCmdResultFailed
+		return
+	}
+	options, err := storage.ParseOptions(m.args[1:])
+	if err != nil {
+		log.Println(err)
+		m.result = MetaCmdResultFailed
+		return
+	}
+	if err := openDatabase(m.args[0], options); err != nil {
+		log.Println(err)
+		m.result = MetaCmdResultFailed
+		return
+	}
+	log.Printf("Opened database %s, journal mode %s\n", db.Path, options.JournalMode)
+}
+
 func (m *metaCommand) exit() {
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close %s: %s\n", db.Path, err)
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
 
-func executeMetaCmd(ib *inputBuffer) {
+// Run the meta command and report its failure, returns its result
+func executeMetaCmd(ib *inputBuffer) MetaCommandResult {
 	op := ib.args[0]
 
 	metacmd := &metaCommand{}
 	metacmd.str = op
+	metacmd.args = ib.args[1:]
 
 	switch op {
 	case ".exit":
@@ -62,6 +231,42 @@ func executeMetaCmd(ib *inputBuffer) {
 			metacmd.result = MetaCmdResultPending
 			metacmd.callback = metacmd.printHelp
 		}
+	case ".btree":
+		{
+			metacmd.typ = MetaCmdBTree
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.printTree
+		}
+	case ".check":
+		{
+			metacmd.typ = MetaCmdCheck
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.checkTree
+		}
+	case ".stats":
+		{
+			metacmd.typ = MetaCmdStats
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.printStats
+		}
+	case ".vacuum":
+		{
+			metacmd.typ = MetaCmdVacuum
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.vacuum
+		}
+	case ".tables":
+		{
+			metacmd.typ = MetaCmdTables
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.printTables
+		}
+	case ".open":
+		{
+			metacmd.typ = MetaCmdOpen
+			metacmd.result = MetaCmdResultPending
+			metacmd.callback = metacmd.open
+		}
 	default:
 		{
 			metacmd.typ = MetaCmdTypeUnrecognized
@@ -81,4 +286,5 @@ func executeMetaCmd(ib *inputBuffer) {
 	case MetaCmdResultUnrecognized:
 		log.Printf("Failed to recognize meta command: %v\n", metacmd.str)
 	}
+	return metacmd.result
 }
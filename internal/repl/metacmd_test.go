@@ -0,0 +1,35 @@
+package repl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tomial/go-db/internal/storage"
+)
+
+func TestCheckResult(t *testing.T) {
+	openTestDatabase(t)
+	runStatement(t, "insert 1 alice alice@example.com")
+	if result := executeMetaCmd(&inputBuffer{args: []string{".check"}}); result == MetaCmdResultFailed {
+		t.Fatal(".check failed on a sound file")
+	}
+
+	// a node count that doesn't match the tree is a violation
+	db.Table("User").BTree.NumNode++
+	if result := executeMetaCmd(&inputBuffer{args: []string{".check"}}); result != MetaCmdResultFailed {
+		t.Fatalf(".check returned %d with a violation, expected %d", result, MetaCmdResultFailed)
+	}
+}
+
+// The checker reports a missing file instead of creating an empty database
+func TestCheckMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "typo.db")
+	if Check(path, storage.Options{}) {
+		t.Fatal("Check: missing file reported as sound")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Check: created the missing file %s", path)
+	}
+}
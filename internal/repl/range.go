@@ -0,0 +1,176 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tomial/go-db/internal/btree"
+)
+
+func isNumber(arg string) bool {
+	_, err := strconv.ParseUint(arg, 10, 32)
+	return err == nil
+}
+
+func parseKey(arg string) (uint32, error) {
+	num, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", arg)
+	}
+	return uint32(num), nil
+}
+
+// Parse the range of a select statement, args are the ones after select:
+//
+//	(empty)                              every row
+//	1000..2000, 1000.., ..2000           inclusive bounds
+//	[1000,2000) (1000,2000] ...          interval notation, [ ] inclusive, ( ) exclusive
+//	where id between 1000 and 2000       inclusive bounds
+//	where id > 1000 and id <= 2000       comparisons on id joined with and
+//
+// followed by an optional asc or desc for the order.
+func parseRange(args []string) (lower, upper btree.Bound, reverse bool, err error) {
+	lower = btree.Bound{Unbounded: true}
+	upper = btree.Bound{Unbounded: true}
+
+	if len(args) > 0 {
+		switch strings.ToLower(args[len(args)-1]) {
+		case "desc":
+			reverse = true
+			args = args[:len(args)-1]
+		case "asc":
+			args = args[:len(args)-1]
+		}
+	}
+
+	switch {
+	case len(args) == 0:
+		return
+	case len(args) == 1 && isNumber(args[0]):
+		lower.Key, err = parseKey(args[0])
+		lower.Unbounded, lower.Inclusive = false, true
+		upper = lower
+	case len(args) == 1 && strings.Contains(args[0], ".."):
+		lower, upper, err = parseDotRange(args[0])
+	case len(args) == 1:
+		lower, upper, err = parseInterval(args[0])
+	case strings.ToLower(args[0]) == "where":
+		lower, upper, err = parseWhere(args[1:])
+	default:
+		err = fmt.Errorf("unrecognized range %q", strings.Join(args, " "))
+	}
+	return
+}
+
+// 1000..2000 with optional ends
+func parseDotRange(arg string) (lower, upper btree.Bound, err error) {
+	lower = btree.Bound{Unbounded: true}
+	upper = btree.Bound{Unbounded: true}
+
+	ends := strings.SplitN(arg, "..", 2)
+	if ends[0] != "" {
+		lower.Unbounded = false
+		lower.Inclusive = true
+		lower.Key, err = parseKey(ends[0])
+		if err != nil {
+			return
+		}
+	}
+	if ends[1] != "" {
+		upper.Unbounded = false
+		upper.Inclusive = true
+		upper.Key, err = parseKey(ends[1])
+	}
+	return
+}
+
+// [1000,2000) with optional ends
+func parseInterval(arg string) (lower, upper btree.Bound, err error) {
+	lower = btree.Bound{Unbounded: true}
+	upper = btree.Bound{Unbounded: true}
+
+	if len(arg) < 3 || !strings.ContainsAny(arg[:1], "[(") || !strings.ContainsAny(arg[len(arg)-1:], "])") {
+		err = fmt.Errorf("unrecognized range %q", arg)
+		return
+	}
+	ends := strings.Split(arg[1:len(arg)-1], ",")
+	if len(ends) != 2 {
+		err = fmt.Errorf("unrecognized range %q", arg)
+		return
+	}
+	if ends[0] != "" {
+		lower.Unbounded = false
+		lower.Inclusive = arg[0] == '['
+		lower.Key, err = parseKey(ends[0])
+		if err != nil {
+			return
+		}
+	}
+	if ends[1] != "" {
+		upper.Unbounded = false
+		upper.Inclusive = arg[len(arg)-1] == ']'
+		upper.Key, err = parseKey(ends[1])
+	}
+	return
+}
+
+// id between 1000 and 2000, or id > 1000 and id <= 2000
+func parseWhere(args []string) (lower, upper btree.Bound, err error) {
+	lower = btree.Bound{Unbounded: true}
+	upper = btree.Bound{Unbounded: true}
+
+	if len(args) == 5 && strings.ToLower(args[1]) == "between" && strings.ToLower(args[3]) == "and" {
+		if strings.ToLower(args[0]) != "id" {
+			err = fmt.Errorf("range on column %q is not supported, only id", args[0])
+			return
+		}
+		lower = btree.Bound{Inclusive: true}
+		upper = btree.Bound{Inclusive: true}
+		if lower.Key, err = parseKey(args[2]); err != nil {
+			return
+		}
+		upper.Key, err = parseKey(args[4])
+		return
+	}
+
+	for len(args) > 0 {
+		if len(args) < 3 {
+			err = fmt.Errorf("incomplete condition %q", strings.Join(args, " "))
+			return
+		}
+		if strings.ToLower(args[0]) != "id" {
+			err = fmt.Errorf("range on column %q is not supported, only id", args[0])
+			return
+		}
+		var k uint32
+		if k, err = parseKey(args[2]); err != nil {
+			return
+		}
+		switch args[1] {
+		case ">":
+			lower = btree.Bound{Key: k}
+		case ">=":
+			lower = btree.Bound{Key: k, Inclusive: true}
+		case "<":
+			upper = btree.Bound{Key: k}
+		case "<=":
+			upper = btree.Bound{Key: k, Inclusive: true}
+		case "=":
+			lower = btree.Bound{Key: k, Inclusive: true}
+			upper = btree.Bound{Key: k, Inclusive: true}
+		default:
+			err = fmt.Errorf("unsupported operator %q", args[1])
+			return
+		}
+		args = args[3:]
+		if len(args) > 0 {
+			if strings.ToLower(args[0]) != "and" {
+				err = fmt.Errorf("expected and, found %q", args[0])
+				return
+			}
+			args = args[1:]
+		}
+	}
+	return
+}
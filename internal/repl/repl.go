@@ -6,9 +6,78 @@ import (
 	"log"
 	"os"
 	"strings"
+
+	"github.com/tomial/go-db/internal/row"
+	"github.com/tomial/go-db/internal/storage"
 )
 
-func Run() {
+// The database the statements and meta commands run against
+var db *storage.DB
+
+// Open the database at path, replacing the current one. The current one is
+// closed first, so the two never share the log of the same file, and it's
+// opened again if the new one can't be.
+func openDatabase(path string, options storage.Options) error {
+	if db == nil {
+		newDB, err := openWithUserTable(path, options)
+		if err != nil {
+			return err
+		}
+		db = newDB
+		return nil
+	}
+
+	old := db
+	if err := old.Close(); err != nil {
+		log.Printf("Failed to close %s: %s\n", old.Path, err)
+	}
+	newDB, err := openWithUserTable(path, options)
+	if err != nil {
+		restored, restoreErr := storage.Open(old.Path, old.Options())
+		if restoreErr != nil {
+			return fmt.Errorf("%w, reopening %s: %w", err, old.Path, restoreErr)
+		}
+		db = restored
+		return err
+	}
+	db = newDB
+	return nil
+}
+
+// Open the database at path. Table User of the statements without a table
+// is created if it's missing.
+func openWithUserTable(path string, options storage.Options) (*storage.DB, error) {
+	newDB, err := storage.Open(path, options)
+	if err != nil {
+		return nil, err
+	}
+	if newDB.Table("User") == nil {
+		_, err := newDB.CreateTable("User", row.UserColumns)
+		if err == nil {
+			err = newDB.Flush()
+		}
+		if err != nil {
+			newDB.Close()
+			return nil, fmt.Errorf("creating table User: %w", err)
+		}
+	}
+	return newDB, nil
+}
+
+// Compact the database file and report its size before and after
+func vacuumDatabase() error {
+	before, after, err := db.Vacuum()
+	if err != nil {
+		return err
+	}
+	log.Printf("Vacuumed %s from %d to %d bytes\n", db.Path, before, after)
+	return nil
+}
+
+func Run(path string, options storage.Options) {
+	if err := openDatabase(path, options); err != nil {
+		log.Fatal(err)
+	}
 	for {
 		fmt.Print("db > ")
 
@@ -39,6 +108,9 @@ func Run() {
 				continue
 			}
 			stm.Execute()
+			if err := db.Flush(); err != nil {
+				log.Printf("Failed to write changes to %s: %s\n", db.Path, err)
+			}
 		}
 	}
 }
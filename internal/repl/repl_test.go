@@ -0,0 +1,53 @@
+package repl
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// Capture what's logged until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// Opening the current file again, in WAL mode or in another journal mode,
+// closes the current handle first so its log isn't shared with the new one
+func TestOpenDatabaseSamePath(t *testing.T) {
+	path := openTestDatabase(t)
+	runStatement(t, "insert 1 alice alice@example.com")
+	logged := captureLog(t)
+
+	for _, options := range []storage.Options{{}, {JournalMode: storage.JournalDelete}, {}} {
+		if err := openDatabase(path, options); err != nil {
+			t.Fatal(err)
+		}
+		if logged.Len() > 0 {
+			t.Fatalf("Reopening %s in journal mode %s logged: %s", path, options.JournalMode, logged)
+		}
+		mustLoad(t, 1)
+		if violations := db.Check(); len(violations) > 0 {
+			t.Fatalf("Check found violations after reopening: %v", violations)
+		}
+	}
+}
+
+// The current database is opened again when the new one can't be
+func TestOpenDatabaseFailure(t *testing.T) {
+	path := openTestDatabase(t)
+	runStatement(t, "insert 1 alice alice@example.com")
+
+	if err := openDatabase(t.TempDir(), storage.Options{}); err == nil {
+		t.Fatal("Opening a directory returned no error")
+	}
+	if db.Path != path {
+		t.Fatalf("Database is %s after a failed open, expected %s", db.Path, path)
+	}
+	mustLoad(t, 1)
+}
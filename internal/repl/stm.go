@@ -1,12 +1,15 @@
 package repl
 
 import (
+	"errors"
 	"log"
-	"reflect"
 	"strconv"
 	"strings"
 
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/datatype"
 	"github.com/tomial/go-db/internal/row"
+	"github.com/tomial/go-db/internal/storage"
 )
 
 type StatementType int
@@ -20,81 +23,207 @@ const (
 const (
 	StatementTypeInsert StatementType = iota
 	StatementTypeSelect
+	StatementTypeDelete
+	StatementTypeUpsert
+	StatementTypeUpdate
+	StatementTypeVacuum
+	StatementTypeBegin
+	StatementTypeCommit
+	StatementTypeRollback
+	StatementTypeCreate
+	StatementTypeDrop
+	StatementTypeAlter
 	StatementTypeInvalid
 )
 
 type statement struct {
-	typ  StatementType
-	op   string
-	args []string
-	row  row.Row
+	typ     StatementType
+	op      string
+	args    []string
+	row     row.Row
+	values  map[string]string // column values of update
+	key     string            // primary key of the inserted row
+	table   string            // table of create, drop and alter table
+	columns []storage.Column  // columns of create table, the added column of alter table
+	value   string            // value of the added column in the existing rows
 }
 
 func prepareStm(ib *inputBuffer, stm *statement) PrepareStatementStatus {
 	stm.op = ib.args[0]
 	stm.args = ib.args
 	switch strings.ToLower(stm.op) {
-	case "insert":
+	case "insert", "upsert", "replace":
 		{
-			// TODO Creating table struct with code automatically
-			// TODO Support generic rows
 			stm.typ = StatementTypeInsert
+			if strings.ToLower(stm.op) != "insert" {
+				stm.typ = StatementTypeUpsert
+			}
+			// insert into [table] values ([value], ...)
+			if len(stm.args) > 1 && strings.ToLower(stm.args[1]) == "into" {
+				if len(stm.args) < 4 {
+					log.Printf("Prepare statement: Expected %s into [table] values ([value], ...)\n", stm.op)
+					return PrepareStatementFailed
+				}
+				args, err := parseValues(stm.args[3:])
+				if err != nil {
+					log.Printf("Prepare statement: %s\n", err)
+					return PrepareStatementFailed
+				}
+				row := &row.Record{}
+				if !setTable(&row.TableName, stm.args[2]) {
+					return PrepareStatementFailed
+				}
+				row.DB = db
+				if row.Values, err = rowValues(row.TableName, args); err != nil {
+					log.Printf("Prepare statement: %s\n", err)
+					return PrepareStatementFailed
+				}
+				stm.key = args[0]
+				stm.row = row
+				break
+			}
 
-			row := row.UserRow{}
-			val := reflect.ValueOf(&row).Elem()
-
-			if len(stm.args) != val.NumField() {
-				log.Printf("Prepare statement: Incorrect argument amount, expected %d, found %d\n", len(stm.args), val.NumField())
+			values, err := row.ParseValues(row.UserColumns, stm.args[1:])
+			if err != nil {
+				log.Printf("Prepare statement: %s, expected %s [id] [username] [email]\n", err, stm.op)
 				return PrepareStatementFailed
 			}
-			// fill args into row fields
-			for i := 0; i < val.NumField(); i++ {
-				field := val.Field(i)
-				arg := stm.args[i]
-
-				if field.Kind() != reflect.Struct {
-					if field.CanSet() {
-						switch field.Kind() {
-						case reflect.String:
-							{
-								field.SetString(arg)
-							}
-						case reflect.Uint64:
-							{
-								num, err := strconv.ParseUint(arg, 10, 64)
-								if err != nil {
-									log.Println("Prepare statement: Failed to convert arg to uint64")
-									return PrepareStatementFailed
-								}
-								field.SetUint(num)
-							}
-						case reflect.Int64:
-							{
-								num, err := strconv.ParseInt(arg, 10, 64)
-								if err != nil {
-									log.Println("Prepare statement: Failed to convert arg to int64")
-									return PrepareStatementFailed
-								}
-								field.SetInt(num)
-							}
-						default:
-							{
-								log.Printf("Prepare statement: Not supported type: %v", field.Kind())
-								return PrepareStatementFailed
-							}
-						}
-					}
-				}
+			userRow := &row.UserRow{Id: values[0].Uint, Username: values[1].Str, Email: values[2].Str}
+			if !setUserTable(&userRow.TableName) {
+				return PrepareStatementFailed
 			}
-			stm.row = &row
+			userRow.DB = db
+			stm.key = stm.args[1]
+			stm.row = userRow
 		}
 	case "select":
 		{
 			stm.typ = StatementTypeSelect
+			// select * from [table] [id|range], the args after the table are the ones of select
+			if len(stm.args) > 2 && stm.args[1] == "*" {
+				if len(stm.args) < 4 || strings.ToLower(stm.args[2]) != "from" {
+					log.Println("Prepare statement: Expected select * from [table] [id|range]")
+					return PrepareStatementFailed
+				}
+				row := &row.Record{}
+				if !setTable(&row.TableName, stm.args[3]) {
+					return PrepareStatementFailed
+				}
+				row.DB = db
+				stm.args = append([]string{stm.op}, stm.args[4:]...)
+				stm.row = row
+				break
+			}
 			row := &row.UserRow{}
-			row.TableName = "User"
+			if !setUserTable(&row.TableName) {
+				return PrepareStatementFailed
+			}
+			row.DB = db
 			stm.row = row
 		}
+	case "delete":
+		{
+			// TODO delete where ...
+			stm.typ = StatementTypeDelete
+			if len(stm.args) != 2 {
+				log.Printf("Prepare statement: Incorrect argument amount, expected %d, found %d\n", 2, len(stm.args))
+				return PrepareStatementFailed
+			}
+			row := &row.UserRow{}
+			if !setUserTable(&row.TableName) {
+				return PrepareStatementFailed
+			}
+			row.DB = db
+			stm.row = row
+		}
+	case "update":
+		{
+			// update [id] set [column]=[value], [column]=[value]
+			stm.typ = StatementTypeUpdate
+			if len(stm.args) < 4 || strings.ToLower(stm.args[2]) != "set" {
+				log.Println("Prepare statement: Expected update [id] set [column]=[value], ...")
+				return PrepareStatementFailed
+			}
+			stm.values = make(map[string]string)
+			for _, assignment := range strings.Split(strings.Join(stm.args[3:], " "), ",") {
+				column, value, ok := strings.Cut(strings.TrimSpace(assignment), "=")
+				if !ok || strings.TrimSpace(column) == "" {
+					log.Printf("Prepare statement: Invalid assignment %q\n", assignment)
+					return PrepareStatementFailed
+				}
+				stm.values[strings.TrimSpace(column)] = strings.TrimSpace(value)
+			}
+			row := &row.UserRow{}
+			if !setUserTable(&row.TableName) {
+				return PrepareStatementFailed
+			}
+			row.DB = db
+			stm.row = row
+		}
+	case "create":
+		{
+			// create table [name] ([column] [type], ...)
+			stm.typ = StatementTypeCreate
+			if len(stm.args) < 3 || strings.ToLower(stm.args[1]) != "table" {
+				log.Println("Prepare statement: Expected create table [name] ([column] [type], ...)")
+				return PrepareStatementFailed
+			}
+			var err error
+			stm.table, stm.columns, err = parseCreateTable(stm.args[2:])
+			if err != nil {
+				log.Printf("Prepare statement: %s\n", err)
+				return PrepareStatementFailed
+			}
+		}
+	case "drop":
+		{
+			// drop table [name]
+			stm.typ = StatementTypeDrop
+			if len(stm.args) != 3 || strings.ToLower(stm.args[1]) != "table" {
+				log.Println("Prepare statement: Expected drop table [name]")
+				return PrepareStatementFailed
+			}
+			stm.table = stm.args[2]
+		}
+	case "alter":
+		{
+			// alter table [name] add column [column] [type] default [value]
+			stm.typ = StatementTypeAlter
+			if len(stm.args) < 3 || strings.ToLower(stm.args[1]) != "table" {
+				log.Println("Prepare statement: Expected alter table [name] add column [column] [type] default [value]")
+				return PrepareStatementFailed
+			}
+			stm.table = stm.args[2]
+			column, value, err := parseAddColumn(stm.args[3:])
+			if err != nil {
+				log.Printf("Prepare statement: %s\n", err)
+				return PrepareStatementFailed
+			}
+			stm.columns, stm.value = []storage.Column{column}, value
+		}
+	case "vacuum":
+		{
+			stm.typ = StatementTypeVacuum
+			if len(stm.args) != 1 {
+				log.Printf("Prepare statement: Incorrect argument amount, expected %d, found %d\n", 1, len(stm.args))
+				return PrepareStatementFailed
+			}
+		}
+	case "begin", "commit", "rollback":
+		{
+			switch strings.ToLower(stm.op) {
+			case "begin":
+				stm.typ = StatementTypeBegin
+			case "commit":
+				stm.typ = StatementTypeCommit
+			default:
+				stm.typ = StatementTypeRollback
+			}
+			if len(stm.args) != 1 {
+				log.Printf("Prepare statement: Incorrect argument amount, expected %d, found %d\n", 1, len(stm.args))
+				return PrepareStatementFailed
+			}
+		}
 	default:
 		{
 			stm.typ = StatementTypeInvalid
@@ -104,6 +233,33 @@ func prepareStm(ib *inputBuffer, stm *statement) PrepareStatementStatus {
 	return PrepareStatementSuccess
 }
 
+// Set the table of a row, the table must exist
+func setTable(tableName *string, name string) bool {
+	if db.Table(name) == nil {
+		log.Printf("Prepare statement: %s: %s\n", storage.ErrNoSuchTable, name)
+		return false
+	}
+	*tableName = name
+	return true
+}
+
+// Parse the values of a row of the table
+func rowValues(table string, args []string) ([]datatype.Value, error) {
+	return row.ParseValues(db.Table(table).Columns, args)
+}
+
+// Set table User as the table of a row, its columns must be the fields of UserRow
+func setUserTable(tableName *string) bool {
+	if !setTable(tableName, "User") {
+		return false
+	}
+	if t := db.Table("User"); t.Schema() != (&storage.Table{Columns: row.UserColumns}).Schema() {
+		log.Printf("Prepare statement: table User was altered to (%s), use insert into and select * from\n", t.Schema())
+		return false
+	}
+	return true
+}
+
 func (stm *statement) Execute() {
 	switch stm.typ {
 	case StatementTypeSelect:
@@ -114,6 +270,46 @@ func (stm *statement) Execute() {
 		{
 			runInsert(stm)
 		}
+	case StatementTypeDelete:
+		{
+			runDelete(stm)
+		}
+	case StatementTypeUpsert:
+		{
+			runUpsert(stm)
+		}
+	case StatementTypeUpdate:
+		{
+			runUpdate(stm)
+		}
+	case StatementTypeVacuum:
+		{
+			runVacuum(stm)
+		}
+	case StatementTypeBegin:
+		{
+			runBegin(stm)
+		}
+	case StatementTypeCommit:
+		{
+			runCommit(stm)
+		}
+	case StatementTypeRollback:
+		{
+			runRollback(stm)
+		}
+	case StatementTypeCreate:
+		{
+			runCreate(stm)
+		}
+	case StatementTypeDrop:
+		{
+			runDrop(stm)
+		}
+	case StatementTypeAlter:
+		{
+			runAlter(stm)
+		}
 	case StatementTypeInvalid:
 		{
 			log.Println("Execute statement error: Invalid statement type")
@@ -126,9 +322,25 @@ func (stm *statement) Execute() {
 }
 
 func runSelect(stm *statement) {
+	// select without a single id loads a range of rows, or the whole table
+	if len(stm.args) != 2 || !isNumber(stm.args[1]) {
+		lower, upper, reverse, err := parseRange(stm.args[1:])
+		if err != nil {
+			log.Printf("Failed to run select, error parsing range: %s\n", err)
+			return
+		}
+		stm.row.InitCursor(0)
+		err = stm.row.LoadRange(lower, upper, reverse)
+		if err != nil {
+			log.Printf("Failed to run select, error loading data: %s\n", err)
+		}
+		return
+	}
+
 	index, err := strconv.ParseUint(stm.args[1], 10, 64)
 	if err != nil {
 		log.Printf("Failed to run select, error parsing row index: %s\n", err)
+		return
 	}
 	stm.row.InitCursor(uint32(index))
 	err = stm.row.Load()
@@ -138,14 +350,105 @@ func runSelect(stm *statement) {
 }
 
 func runInsert(stm *statement) {
-	index, err := strconv.ParseUint(stm.args[1], 10, 64)
+	index, err := strconv.ParseUint(stm.key, 10, 32)
 	if err != nil {
-		log.Fatalf("Failed to parse id: %s", err.Error())
+		log.Printf("Failed to run insert, error parsing id: %s\n", err)
+		return
 	}
 	n, err := stm.row.Save(uint32(index))
+	if errors.Is(err, btree.ErrDuplicateKey) {
+		log.Printf("Failed to run insert: constraint violation, id %d is the primary key of an existing row in table %s, use upsert to replace it\n", index, stm.row.Table().String())
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to run insert: %s", err.Error())
 		return
 	}
 	log.Printf("Inserted %d bytes to table %s\n", n, stm.row.Table().String())
 }
+
+func runUpsert(stm *statement) {
+	index, err := strconv.ParseUint(stm.key, 10, 32)
+	if err != nil {
+		log.Printf("Failed to run upsert, error parsing id: %s\n", err)
+		return
+	}
+	n, replaced, err := stm.row.Upsert(uint32(index))
+	if err != nil {
+		log.Printf("Failed to run upsert: %s\n", err.Error())
+		return
+	}
+	if replaced {
+		log.Printf("Replaced row %d with %d bytes in table %s\n", index, n, stm.row.Table().String())
+	} else {
+		log.Printf("Inserted %d bytes to table %s\n", n, stm.row.Table().String())
+	}
+}
+
+func runDelete(stm *statement) {
+	index, err := parseKey(stm.args[1])
+	if err != nil {
+		log.Printf("Failed to run delete, error parsing row index: %s\n", err)
+		return
+	}
+	stm.row.InitCursor(index)
+	removed, err := stm.row.Table().Remove(index)
+	if err != nil {
+		log.Printf("Failed to run delete: %s\n", err)
+		return
+	}
+	if removed {
+		log.Printf("Deleted row %d from table %s\n", index, stm.row.Table().String())
+	} else {
+		log.Printf("Row %d not found in table %s\n", index, stm.row.Table().String())
+	}
+}
+
+func runUpdate(stm *statement) {
+	index, err := parseKey(stm.args[1])
+	if err != nil {
+		log.Printf("Failed to run update, error parsing id: %s\n", err)
+		return
+	}
+	stm.row.InitCursor(index)
+	n, err := stm.row.Update(index, stm.values)
+	if errors.Is(err, btree.ErrKeyNotFound) {
+		log.Printf("Row %d not found in table %s\n", index, stm.row.Table().String())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to run update: %s\n", err.Error())
+		return
+	}
+	log.Printf("Updated row %d with %d bytes in table %s\n", index, n, stm.row.Table().String())
+}
+
+func runVacuum(stm *statement) {
+	if err := vacuumDatabase(); err != nil {
+		log.Printf("Failed to run vacuum: %s\n", err)
+	}
+}
+
+func runBegin(stm *statement) {
+	if err := db.Begin(); err != nil {
+		log.Printf("Failed to run begin: %s\n", err)
+		return
+	}
+	log.Println("Transaction started")
+}
+
+func runCommit(stm *statement) {
+	if err := db.Commit(); err != nil {
+		log.Printf("Failed to run commit: %s\n", err)
+		return
+	}
+	log.Println("Transaction committed")
+}
+
+func runRollback(stm *statement) {
+	if err := db.Rollback(); err != nil {
+		log.Printf("Failed to run rollback: %s\n", err)
+		return
+	}
+	log.Println("Transaction rolled back")
+}
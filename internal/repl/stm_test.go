@@ -0,0 +1,71 @@
+package repl
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// Open a new database as the one of the statements, it's closed when the test ends.
+// Returns its path.
+func openTestDatabase(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := openDatabase(path, storage.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+	})
+	return path
+}
+
+// Prepare and execute a statement as typed in the REPL
+func runStatement(t *testing.T, line string) {
+	stm := statement{}
+	if prepareStm(&inputBuffer{args: strings.Split(line, " ")}, &stm) == PrepareStatementFailed {
+		t.Fatalf("Failed to prepare statement %q", line)
+	}
+	stm.Execute()
+}
+
+func mustLoad(t *testing.T, key uint32) []byte {
+	data, err := db.Table("User").Load(key)
+	if err != nil {
+		t.Fatalf("Row %d: %s", key, err)
+	}
+	return data
+}
+
+// An id past uint32 is rejected instead of being truncated to the id of another row
+func TestDeleteIdOutOfRange(t *testing.T) {
+	openTestDatabase(t)
+	runStatement(t, "insert 1 alice alice@example.com")
+
+	runStatement(t, "delete 4294967297")
+	mustLoad(t, 1)
+
+	runStatement(t, "delete 1")
+	if data, err := db.Table("User").Load(1); err == nil {
+		t.Fatalf("Delete: row 1 is still there: %q", data)
+	}
+}
+
+func TestUpdateIdOutOfRange(t *testing.T) {
+	openTestDatabase(t)
+	runStatement(t, "insert 2 bob bob@example.com")
+	before := mustLoad(t, 2)
+
+	runStatement(t, "update 4294967298 set username=mallory")
+	if after := mustLoad(t, 2); !bytes.Equal(after, before) {
+		t.Fatalf("Update: row 2 changed to %q by an id out of range", after)
+	}
+
+	runStatement(t, "update 2 set username=carol")
+	if after := mustLoad(t, 2); bytes.Equal(after, before) {
+		t.Fatal("Update: row 2 wasn't updated")
+	}
+}
@@ -0,0 +1,111 @@
+package repl
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tomial/go-db/internal/datatype"
+	"github.com/tomial/go-db/internal/row"
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// Parse the args after create table: name (column type, column type, ...)
+func parseCreateTable(args []string) (name string, columns []storage.Column, err error) {
+	def := strings.TrimSpace(strings.Join(args, " "))
+	name, list, ok := strings.Cut(def, "(")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || !strings.HasSuffix(list, ")") {
+		return "", nil, fmt.Errorf("expected create table [name] ([column] [type], ...), found %q", def)
+	}
+	for _, column := range strings.Split(strings.TrimSuffix(list, ")"), ",") {
+		fields := strings.Fields(column)
+		if len(fields) != 2 {
+			return "", nil, fmt.Errorf("invalid column definition %q, expected [column] [type]", strings.TrimSpace(column))
+		}
+		typ, err := datatype.ParseType(strings.ToLower(fields[1]))
+		if err != nil {
+			return "", nil, fmt.Errorf("column %s: %w", fields[0], err)
+		}
+		columns = append(columns, storage.Column{Name: fields[0], Type: typ})
+	}
+	return name, columns, nil
+}
+
+// Parse the args after the table name of insert into: values (value, value, ...).
+// Quotes around a value are removed, a value can't contain a comma.
+func parseValues(args []string) ([]string, error) {
+	list := strings.TrimSpace(strings.Join(args, " "))
+	if len(list) < 6 || !strings.EqualFold(list[:6], "values") {
+		return nil, fmt.Errorf("expected values ([value], ...), found %q", list)
+	}
+	list = strings.TrimSpace(list[6:])
+	if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+		return nil, fmt.Errorf("expected values ([value], ...), found %q", list)
+	}
+	values := strings.Split(list[1:len(list)-1], ",")
+	for i, value := range values {
+		values[i] = unquote(strings.TrimSpace(value))
+	}
+	return values, nil
+}
+
+// Remove the single or double quotes around the value
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Parse the args after the table name of alter table: add column [column] [type] default [value].
+// column after add and the default value are optional.
+func parseAddColumn(args []string) (column storage.Column, value string, err error) {
+	usage := fmt.Errorf("expected add column [column] [type] default [value], found %q", strings.Join(args, " "))
+	if len(args) < 3 || strings.ToLower(args[0]) != "add" {
+		return column, "", usage
+	}
+	args = args[1:]
+	if strings.ToLower(args[0]) == "column" {
+		args = args[1:]
+	}
+	if len(args) != 2 && (len(args) < 4 || strings.ToLower(args[2]) != "default") {
+		return column, "", usage
+	}
+	typ, err := datatype.ParseType(strings.ToLower(args[1]))
+	if err != nil {
+		return column, "", fmt.Errorf("column %s: %w", args[0], err)
+	}
+	if len(args) > 2 {
+		value = unquote(strings.Join(args[3:], " "))
+	}
+	return storage.Column{Name: args[0], Type: typ}, value, nil
+}
+
+func runCreate(stm *statement) {
+	t, err := db.CreateTable(stm.table, stm.columns)
+	if err != nil {
+		log.Printf("Failed to run create table: %s\n", err)
+		return
+	}
+	log.Printf("Created table %s (%s)\n", t.String(), t.Schema())
+}
+
+func runDrop(stm *statement) {
+	if err := db.DropTable(stm.table); err != nil {
+		log.Printf("Failed to run drop table: %s\n", err)
+		return
+	}
+	log.Printf("Dropped table %s\n", stm.table)
+}
+
+func runAlter(stm *statement) {
+	t, err := row.AddColumn(db, stm.table, stm.columns[0], stm.value)
+	if err != nil {
+		log.Printf("Failed to run alter table: %s\n", err)
+		if t == nil {
+			return
+		}
+	}
+	log.Printf("Altered table %s to (%s)\n", t.String(), t.Schema())
+}
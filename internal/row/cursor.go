@@ -1,28 +1,65 @@
 package row
 
-import "github.com/tomial/go-db/internal/storage"
+import (
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/storage"
+)
 
 type cursor struct {
-	table      *storage.Table
-	isEnd      bool
-	currentRow uint32
+	table *storage.Table
+	tree  *btree.Cursor // position in the table's tree
+	index uint32        // id of the row the cursor was initialized at
+}
+
+func newCursor(table *storage.Table, index uint32) *cursor {
+	c := &cursor{
+		table: table,
+		tree:  table.BTree.Cursor(),
+		index: index,
+	}
+	c.seek(index)
+	return c
 }
 
 // Move to start
 func (c *cursor) tableStart() {
-	c.currentRow = 1
+	c.tree.First()
 }
 
 // Move to the last row
 func (c *cursor) tableEnd() {
-	c.currentRow = c.table.RowNum
+	c.tree.Last()
+}
+
+// Move to the row with the id, or the first row after it
+func (c *cursor) seek(index uint32) {
+	c.tree.Seek(index)
+}
+
+// The cursor moved past the last row
+func (c *cursor) isEnd() bool {
+	return !c.tree.Valid()
+}
+
+// The error of a failed page read while moving the cursor
+func (c *cursor) err() error {
+	return c.tree.Err()
+}
+
+// The cursor is at the row it was initialized at
+func (c *cursor) atIndex() bool {
+	return !c.isEnd() && c.currentPos() == c.index
 }
 
 func (c *cursor) currentPos() uint32 {
-	return c.currentRow
+	return c.tree.Key()
+}
+
+func (c *cursor) value() []byte {
+	return c.tree.Value()
 }
 
-// Move to next position for inserting
+// Move to the next row in id order
 func (c *cursor) advance() {
-	c.currentRow += 1
+	c.tree.Next()
 }
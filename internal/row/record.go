@@ -0,0 +1,190 @@
+package row
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/datatype"
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// A row of any table, its values are encoded by the columns of the table
+type Record struct {
+	emptyRow
+	Values []datatype.Value // values of the columns in column order
+
+	// prints the loaded rows, the values with their column names when nil
+	print func(t *storage.Table, values []datatype.Value)
+}
+
+// Parse the values of a row of the columns as written in a statement
+func ParseValues(columns []storage.Column, args []string) ([]datatype.Value, error) {
+	if len(args) != len(columns) {
+		return nil, fmt.Errorf("%d values for %d columns", len(args), len(columns))
+	}
+	values := make([]datatype.Value, len(columns))
+	for i, c := range columns {
+		v, err := datatype.ParseValue(c.Type, args[i])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (row *Record) Save(index uint32) (n int, err error) {
+	if row.Cursor == nil {
+		row.InitCursor(index)
+	}
+	bytes, err := serialize(row.Cursor.table.Columns, row.Values)
+	if err != nil {
+		return 0, err
+	}
+	if err := row.Cursor.table.Persist(bytes, index); err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
+
+// Save the row, overwriting the existing row with the same primary key
+func (row *Record) Upsert(index uint32) (n int, replaced bool, err error) {
+	if row.Cursor == nil {
+		row.InitCursor(index)
+	}
+	bytes, err := serialize(row.Cursor.table.Columns, row.Values)
+	if err != nil {
+		return 0, false, err
+	}
+	replaced, err = row.Cursor.table.Replace(bytes, index)
+	if err != nil {
+		return 0, false, err
+	}
+	return len(bytes), replaced, nil
+}
+
+// Update the columns of the row with the primary key, values are keyed by column name
+func (row *Record) Update(index uint32, values map[string]string) (n int, err error) {
+	if row.Cursor == nil {
+		row.InitCursor(index)
+	}
+	if err := row.Cursor.err(); err != nil {
+		return 0, err
+	}
+	if !row.Cursor.atIndex() {
+		return 0, fmt.Errorf("%w: %d", btree.ErrKeyNotFound, index)
+	}
+	t := row.Cursor.table
+	updated, err := deserialize(t.Columns, row.Cursor.value())
+	if err != nil {
+		return 0, err
+	}
+
+	for column, value := range values {
+		i := columnIndex(t.Columns, column)
+		if i < 0 {
+			return 0, fmt.Errorf("updating row: unknown column %s", column)
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("updating row: %s is the primary key and can't be updated", t.Columns[0].Name)
+		}
+		v, err := datatype.ParseValue(t.Columns[i].Type, value)
+		if err != nil {
+			return 0, fmt.Errorf("updating row: column %s: %w", column, err)
+		}
+		updated[i] = v
+	}
+
+	bytes, err := serialize(t.Columns, updated)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.Update(bytes, index); err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
+
+func columnIndex(columns []storage.Column, name string) int {
+	for i, c := range columns {
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Load the row the cursor was initialized at
+func (row *Record) Load() (err error) {
+	if err := row.Cursor.err(); err != nil {
+		return err
+	}
+	if !row.Cursor.atIndex() {
+		return fmt.Errorf("error loading table %s: key %d not found", row.Cursor.table.String(), row.Cursor.index)
+	}
+	return row.printRow(row.Cursor.value())
+}
+
+// Load the rows with the primary key between lower and upper, in key order or reverse order
+func (row *Record) LoadRange(lower, upper btree.Bound, reverse bool) (err error) {
+	count := 0
+	err = row.Cursor.table.Range(lower, upper, reverse, func(key uint32, data []byte) error {
+		count++
+		return row.printRow(data)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Loaded %d rows from table %s\n", count, row.Cursor.table.String())
+	return nil
+}
+
+func (row *Record) printRow(data []byte) error {
+	t := row.Cursor.table
+	values, err := deserialize(t.Columns, data)
+	if err != nil {
+		return err
+	}
+	if row.print != nil {
+		row.print(t, values)
+		return nil
+	}
+	columns := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		columns[i] = c.Name + "-> " + values[i].String()
+	}
+	log.Printf("Loaded [ %s: %s ]\n", t.String(), strings.Join(columns, ", "))
+	return nil
+}
+
+// Add a column at the end of the columns of the table. The rows are read with
+// the old columns and rewritten with value in the new column, the zero value
+// of its type when value is empty. Returns the altered table, like
+// storage.DB.AlterTable.
+func AddColumn(db *storage.DB, table string, column storage.Column, value string) (*storage.Table, error) {
+	t := db.Table(table)
+	if t == nil {
+		return nil, fmt.Errorf("adding column %s: %w: %s", column.Name, storage.ErrNoSuchTable, table)
+	}
+	defaultValue := datatype.ZeroValue(column.Type)
+	if value != "" {
+		v, err := datatype.ParseValue(column.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("adding column %s: %w", column.Name, err)
+		}
+		defaultValue = v
+	}
+
+	oldColumns := t.Columns
+	columns := append(append([]storage.Column{}, oldColumns...), column)
+	return db.AlterTable(table, columns, func(data []byte) ([]byte, error) {
+		values, err := deserialize(oldColumns, data)
+		if err != nil {
+			return nil, err
+		}
+		return serialize(columns, append(values, defaultValue))
+	})
+}
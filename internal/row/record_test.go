@@ -0,0 +1,132 @@
+package row
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tomial/go-db/internal/datatype"
+	"github.com/tomial/go-db/internal/storage"
+)
+
+// Open a database with a table of users keyed 1 to count, it's closed when the test ends
+func openUserTable(t *testing.T, path string, count int) *storage.DB {
+	db, err := storage.Open(path, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	table, err := db.CreateTable("users", UserColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 1; key <= count; key++ {
+		data, err := serialize(UserColumns, userValues(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := table.Persist(data, uint32(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func userValues(key int) []datatype.Value {
+	return []datatype.Value{
+		datatype.UintValue(uint64(key)),
+		datatype.StringValue(fmt.Sprintf("user%d", key)),
+		datatype.StringValue(fmt.Sprintf("user%d@example.com", key)),
+	}
+}
+
+func TestAddColumn(t *testing.T) {
+	tests := []struct {
+		name     string
+		column   storage.Column
+		value    string
+		expected datatype.Value
+	}{
+		{"empty uint default", storage.Column{Name: "age", Type: datatype.TypeUint}, "", datatype.UintValue(0)},
+		{"uint default", storage.Column{Name: "age", Type: datatype.TypeUint}, "18", datatype.UintValue(18)},
+		{"empty int default", storage.Column{Name: "score", Type: datatype.TypeInt}, "", datatype.IntValue(0)},
+		{"int default", storage.Column{Name: "score", Type: datatype.TypeInt}, "-5", datatype.IntValue(-5)},
+		{"empty string default", storage.Column{Name: "city", Type: datatype.TypeString}, "", datatype.StringValue("")},
+		{"string default", storage.Column{Name: "city", Type: datatype.TypeString}, "Paris", datatype.StringValue("Paris")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := openUserTable(t, path, 300)
+
+			table, err := AddColumn(db, "users", test.column, test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			columns := append(append([]storage.Column{}, UserColumns...), test.column)
+			if !reflect.DeepEqual(table.Columns, columns) {
+				t.Fatalf("AddColumn: table has columns %v, expected %v", table.Columns, columns)
+			}
+			if violations := db.Check(); len(violations) > 0 {
+				t.Fatalf("Check found violations after AddColumn: %v", violations)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// every row has its old values and the default in the new column
+			db, err = storage.Open(path, storage.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			count := 0
+			err = db.Table("users").Scan(func(key uint32, data []byte) error {
+				values, err := deserialize(columns, data)
+				if err != nil {
+					return err
+				}
+				if expected := append(userValues(int(key)), test.expected); !reflect.DeepEqual(values, expected) {
+					t.Fatalf("Row %d is %v, expected %v", key, values, expected)
+				}
+				count++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 300 {
+				t.Fatalf("Found %d rows after AddColumn, expected 300", count)
+			}
+		})
+	}
+}
+
+func TestAddColumnErrors(t *testing.T) {
+	db := openUserTable(t, filepath.Join(t.TempDir(), "test.db"), 10)
+	table := db.Table("users")
+
+	tests := []struct {
+		name   string
+		table  string
+		column storage.Column
+		value  string
+	}{
+		{"no such table", "nope", storage.Column{Name: "age", Type: datatype.TypeUint}, ""},
+		{"invalid default", "users", storage.Column{Name: "age", Type: datatype.TypeUint}, "abc"},
+		{"negative uint default", "users", storage.Column{Name: "age", Type: datatype.TypeUint}, "-1"},
+		{"duplicate column", "users", storage.Column{Name: "Email", Type: datatype.TypeString}, ""},
+	}
+	for _, test := range tests {
+		if _, err := AddColumn(db, test.table, test.column, test.value); err == nil {
+			t.Fatalf("AddColumn %s: expected an error", test.name)
+		}
+	}
+	if db.Table("users") != table || !reflect.DeepEqual(table.Columns, UserColumns) {
+		t.Fatalf("A failed AddColumn changed the table to %v", db.Table("users").Columns)
+	}
+	if violations := db.Check(); len(violations) > 0 {
+		t.Fatalf("Check found violations after a failed AddColumn: %v", violations)
+	}
+}
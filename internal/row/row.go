@@ -1,12 +1,16 @@
 package row
 
 import (
+	"github.com/tomial/go-db/internal/btree"
 	"github.com/tomial/go-db/internal/storage"
 )
 
 type Row interface {
 	Save(index uint32) (n int, err error)
+	Upsert(index uint32) (n int, replaced bool, err error)
+	Update(index uint32, values map[string]string) (n int, err error)
 	Load() (err error)
+	LoadRange(lower, upper btree.Bound, reverse bool) (err error)
 	Table() *storage.Table
 	InitCursor(index uint32)
 }
@@ -14,16 +18,14 @@ type Row interface {
 type emptyRow struct {
 	Row
 	Cursor    *cursor
+	DB        *storage.DB
 	TableName string
 }
 
+// Position the cursor at the row with the id
 func (row *emptyRow) InitCursor(index uint32) {
-	t := storage.InitTable(row.TableName)
-	row.Cursor = &cursor{
-		table:      t,
-		isEnd:      t.RowNum == index,
-		currentRow: index,
-	}
+	t := row.DB.Table(row.TableName)
+	row.Cursor = newCursor(t, index)
 }
 
 func (row *emptyRow) Table() *storage.Table {
@@ -2,83 +2,88 @@ package row
 
 import (
 	"encoding/binary"
-	"errors"
-	"reflect"
+	"fmt"
 
 	"github.com/tomial/go-db/internal/datatype"
+	"github.com/tomial/go-db/internal/storage"
 )
 
-// TODO return when data count not equal to col num
-func serialize(row Row, columnSize uint32) (data []byte, err error) {
-	val := reflect.ValueOf(row)
-
-	buf := make([]byte, columnSize)
-	var pos uint32 = 0
-
-	for i := 0; i < val.Elem().NumField(); i++ {
-		fieldType := val.Elem().Field(i).Kind()
+// Encode the values of a row of the columns, in column order. Integers are
+// varints, strings are their length as a uvarint followed by their bytes, so
+// a row takes only the bytes of its values.
+// Rows of the older fixed-size encoding, with every string padded to 255
+// bytes, aren't readable with it: there's no decoder for them, their files
+// are rejected when opened and deserialize rejects such a row.
+func serialize(columns []storage.Column, values []datatype.Value) (data []byte, err error) {
+	if len(values) != len(columns) {
+		return nil, fmt.Errorf("serializing row: %d values for %d columns", len(values), len(columns))
+	}
+	size := 0
+	for _, v := range values {
+		size += binary.MaxVarintLen64 + len(v.Str)
+	}
+	buf := make([]byte, 0, size)
 
-		if fieldType != reflect.Struct && fieldType != reflect.Interface {
-			switch fieldType {
-			case reflect.Uint64:
-				{
-					binary.PutUvarint(buf, val.Elem().Field(i).Uint())
-					pos += datatype.Uint64Size
-				}
-			case reflect.Int64:
-				{
-					binary.PutVarint(buf, val.Elem().Field(i).Int())
-					pos += datatype.Uint64Size
-				}
-			case reflect.String:
-				{
-					copy(buf[pos:pos+255], []byte(val.Elem().Field(i).String()))
-					pos += datatype.StringSize
-				}
-			}
+	for i, c := range columns {
+		v := values[i]
+		if v.Type != c.Type {
+			return nil, fmt.Errorf("serializing row: %s value for column %s of type %s", v.Type, c.Name, c.Type)
+		}
+		switch c.Type {
+		case datatype.TypeUint:
+			buf = binary.AppendUvarint(buf, v.Uint)
+		case datatype.TypeInt:
+			buf = binary.AppendVarint(buf, v.Int)
+		case datatype.TypeString:
+			buf = binary.AppendUvarint(buf, uint64(len(v.Str)))
+			buf = append(buf, v.Str...)
+		default:
+			return nil, fmt.Errorf("serializing row: column %s has an invalid type", c.Name)
 		}
 	}
 
 	return buf, nil
 }
 
-func deserialize(data []byte, tableType reflect.Type) (Row, error) {
-	row := reflect.New(tableType)
-
-	var pos uint32 = 0
+// Decode the values of a row of the columns, read one after another
+func deserialize(columns []storage.Column, data []byte) ([]datatype.Value, error) {
+	values := make([]datatype.Value, len(columns))
+	pos := 0
 
-	for i := 0; i < tableType.NumField(); i++ {
-
-		fieldType := row.Elem().Field(i).Kind()
-
-		if fieldType != reflect.Struct && fieldType != reflect.Interface {
-			switch fieldType {
-			case reflect.Uint64:
-				{
-					udigit, n := binary.Uvarint(data[pos : pos+datatype.Uint64Size])
-					if n <= 0 {
-						return nil, errors.New("deserializing data: invalid size byte slice, too small or too large")
-					}
-					row.Elem().Field(i).SetUint(udigit)
-					pos += datatype.Uint64Size
-				}
-			case reflect.Int64:
-				{
-					digit, n := binary.Varint(data[pos : pos+datatype.Uint64Size])
-					if n <= 0 {
-						return nil, errors.New("deserializing data: invalid size byte slice, too small or too large")
-					}
-					row.Elem().Field(i).SetInt(digit)
-					pos += datatype.Int64Size
-				}
-			case reflect.String:
-				{
-					row.Elem().Field(i).SetString(string(data[pos : pos+datatype.StringSize]))
-					pos += datatype.StringSize
-				}
+	for i, c := range columns {
+		switch c.Type {
+		case datatype.TypeUint:
+			udigit, n := binary.Uvarint(data[pos:])
+			if n <= 0 {
+				return nil, fmt.Errorf("deserializing row: invalid varint of column %s", c.Name)
+			}
+			values[i] = datatype.UintValue(udigit)
+			pos += n
+		case datatype.TypeInt:
+			digit, n := binary.Varint(data[pos:])
+			if n <= 0 {
+				return nil, fmt.Errorf("deserializing row: invalid varint of column %s", c.Name)
 			}
+			values[i] = datatype.IntValue(digit)
+			pos += n
+		case datatype.TypeString:
+			length, n := binary.Uvarint(data[pos:])
+			if n <= 0 {
+				return nil, fmt.Errorf("deserializing row: invalid length of column %s", c.Name)
+			}
+			pos += n
+			if length > uint64(len(data)-pos) {
+				return nil, fmt.Errorf("deserializing row: column %s is %d bytes long, %d bytes left", c.Name, length, len(data)-pos)
+			}
+			values[i] = datatype.StringValue(string(data[pos : pos+int(length)]))
+			pos += int(length)
+		default:
+			return nil, fmt.Errorf("deserializing row: column %s has an invalid type", c.Name)
 		}
 	}
+	if pos != len(data) {
+		return nil, fmt.Errorf("deserializing row: %d bytes after the last column", len(data)-pos)
+	}
 
-	return row.Interface().(Row), nil
+	return values, nil
 }
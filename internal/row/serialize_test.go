@@ -0,0 +1,177 @@
+package row
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tomial/go-db/internal/datatype"
+)
+
+// The fields of UserRow, encoded by the reflective codec the schema codec replaced
+type reflectUserRow struct {
+	Id       uint64
+	Username string
+	Email    string
+}
+
+// Sizes of the fields of the reflective codec, strings were padded to 255 bytes
+const uint64Size uint32 = binary.MaxVarintLen64
+const int64Size uint32 = binary.MaxVarintLen64
+const stringSize uint32 = 255
+
+// The reflective codec walking the fields of a row struct, kept as the baseline of the benchmarks
+func reflectSerialize(val reflect.Value, columnSize uint32) []byte {
+	buf := make([]byte, columnSize)
+	var pos uint32 = 0
+	for i := 0; i < val.NumField(); i++ {
+		switch val.Field(i).Kind() {
+		case reflect.Uint64:
+			binary.PutUvarint(buf[pos:], val.Field(i).Uint())
+			pos += uint64Size
+		case reflect.Int64:
+			binary.PutVarint(buf[pos:], val.Field(i).Int())
+			pos += int64Size
+		case reflect.String:
+			copy(buf[pos:pos+stringSize], val.Field(i).String())
+			pos += stringSize
+		}
+	}
+	return buf
+}
+
+func reflectDeserialize(data []byte, tableType reflect.Type) (reflect.Value, error) {
+	row := reflect.New(tableType)
+	var pos uint32 = 0
+	for i := 0; i < tableType.NumField(); i++ {
+		field := row.Elem().Field(i)
+		switch field.Kind() {
+		case reflect.Uint64:
+			udigit, n := binary.Uvarint(data[pos : pos+uint64Size])
+			if n <= 0 {
+				return reflect.Value{}, errors.New("invalid varint")
+			}
+			field.SetUint(udigit)
+			pos += uint64Size
+		case reflect.Int64:
+			digit, n := binary.Varint(data[pos : pos+int64Size])
+			if n <= 0 {
+				return reflect.Value{}, errors.New("invalid varint")
+			}
+			field.SetInt(digit)
+			pos += int64Size
+		case reflect.String:
+			field.SetString(string(data[pos : pos+stringSize]))
+			pos += stringSize
+		}
+	}
+	return row, nil
+}
+
+var benchUser = reflectUserRow{Id: 1234567, Username: "alice", Email: "alice@example.com"}
+
+var benchValues = []datatype.Value{
+	datatype.UintValue(benchUser.Id),
+	datatype.StringValue(benchUser.Username),
+	datatype.StringValue(benchUser.Email),
+}
+
+const userRowSize = uint64Size + 2*stringSize
+
+func TestSerializeRoundTrip(t *testing.T) {
+	data, err := serialize(UserColumns, benchValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := deserialize(UserColumns, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, benchValues) {
+		t.Fatalf("Deserialize: values %v, expected %v", values, benchValues)
+	}
+
+	// a row takes the bytes of its values: the id varint and the length prefixed strings
+	small := []datatype.Value{datatype.UintValue(1), datatype.StringValue("a"), datatype.StringValue("a@b")}
+	if data, err := serialize(UserColumns, small); err != nil || len(data) != 7 {
+		t.Fatalf("Serialize: row of \"a a@b\" takes %d bytes, expected 7", len(data))
+	}
+
+	// strings are stored whole, with any bytes
+	long := []datatype.Value{datatype.UintValue(1), datatype.StringValue(strings.Repeat("a\x00", 300)), datatype.StringValue("")}
+	data, err = serialize(UserColumns, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, err := deserialize(UserColumns, data); err != nil || !reflect.DeepEqual(values, long) {
+		t.Fatalf("Deserialize: long string not read back whole, error %v", err)
+	}
+}
+
+func TestSerializeErrors(t *testing.T) {
+	if _, err := serialize(UserColumns, benchValues[:2]); err == nil {
+		t.Error("Serialize: missing value returned no error")
+	}
+	mismatch := []datatype.Value{datatype.IntValue(-1), benchValues[1], benchValues[2]}
+	if _, err := serialize(UserColumns, mismatch); err == nil {
+		t.Error("Serialize: int value for a uint column returned no error")
+	}
+	data, err := serialize(UserColumns, benchValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deserialize(UserColumns, data[:len(data)-1]); err == nil {
+		t.Error("Deserialize: truncated row returned no error")
+	}
+	if _, err := deserialize(UserColumns, append(data, 0)); err == nil {
+		t.Error("Deserialize: row with trailing bytes returned no error")
+	}
+}
+
+// Rows of the fixed-size encoding aren't readable, they're rejected instead of misread
+func TestDeserializeFixedSizeRow(t *testing.T) {
+	old := reflectSerialize(reflect.ValueOf(benchUser), userRowSize)
+	if _, err := deserialize(UserColumns, old); err == nil {
+		t.Fatal("Deserialize: row of the fixed-size encoding returned no error")
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := serialize(UserColumns, benchValues); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerializeReflect(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		reflectSerialize(reflect.ValueOf(benchUser), userRowSize)
+	}
+}
+
+func BenchmarkDeserialize(b *testing.B) {
+	data, err := serialize(UserColumns, benchValues)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := deserialize(UserColumns, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeserializeReflect(b *testing.B) {
+	data := reflectSerialize(reflect.ValueOf(benchUser), userRowSize)
+	typ := reflect.TypeOf(benchUser)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := reflectDeserialize(data, typ); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
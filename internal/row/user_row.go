@@ -2,9 +2,10 @@ package row
 
 import (
 	"log"
-	"reflect"
 
+	"github.com/tomial/go-db/internal/btree"
 	"github.com/tomial/go-db/internal/datatype"
+	"github.com/tomial/go-db/internal/storage"
 )
 
 type UserRow struct {
@@ -14,39 +15,56 @@ type UserRow struct {
 	Email    string
 }
 
-func (row *UserRow) Save(index uint32) (n int, err error) {
-	bytes, err := serialize(row, datatype.Uint64Size+2*datatype.StringSize)
-	if err != nil {
-		return 0, err
-	}
+// Schema of table User, the columns of the fields of UserRow
+var UserColumns = []storage.Column{
+	{Name: "id", Type: datatype.TypeUint},
+	{Name: "username", Type: datatype.TypeString},
+	{Name: "email", Type: datatype.TypeString},
+}
+
+// The row as a record of the User schema, sharing its cursor
+func (row *UserRow) record(index uint32) *Record {
 	if row.Cursor == nil {
 		row.InitCursor(index)
 	}
-	err = row.Cursor.table.Persist(bytes, row.Cursor.currentPos())
-	if err != nil {
-		log.Println(err.Error())
-		return 0, nil
-	} else {
-		row.Cursor.advance()
-		return len(bytes), nil
+	return &Record{
+		emptyRow: row.emptyRow,
+		Values: []datatype.Value{
+			datatype.UintValue(row.Id),
+			datatype.StringValue(row.Username),
+			datatype.StringValue(row.Email),
+		},
+		print: func(t *storage.Table, values []datatype.Value) {
+			row.Id, row.Username, row.Email = values[0].Uint, values[1].Str, values[2].Str
+			row.print()
+		},
 	}
 }
 
-func (row *UserRow) Load() (err error) {
-	data, err := row.Cursor.table.Load(row.Cursor.currentPos())
-	if err != nil {
-		return err
-	}
+func (row *UserRow) Save(index uint32) (n int, err error) {
+	return row.record(index).Save(index)
+}
 
-	rowType := reflect.TypeOf(*row)
-	loadedRow, err := deserialize(data, rowType)
-	if err != nil {
-		return err
-	}
+// Save the row, overwriting the existing row with the same id
+func (row *UserRow) Upsert(index uint32) (n int, replaced bool, err error) {
+	return row.record(index).Upsert(index)
+}
 
-	ptr := (loadedRow).(*UserRow)
+// Update the columns of the row with the id, values are keyed by column name
+func (row *UserRow) Update(index uint32, values map[string]string) (n int, err error) {
+	return row.record(index).Update(index, values)
+}
 
-	log.Printf("Loaded [ ID #%d UserRow: Username-> %s, Email-> %s ]\n", ptr.Id, ptr.Username, ptr.Email)
+// Load the row the cursor was initialized at
+func (row *UserRow) Load() (err error) {
+	return row.record(row.Cursor.index).Load()
+}
+
+// Load the rows with id between lower and upper, in id order or reverse order
+func (row *UserRow) LoadRange(lower, upper btree.Bound, reverse bool) (err error) {
+	return row.record(0).LoadRange(lower, upper, reverse)
+}
 
-	return nil
+func (row *UserRow) print() {
+	log.Printf("Loaded [ ID #%d UserRow: Username-> %s, Email-> %s ]\n", row.Id, row.Username, row.Email)
 }
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/datatype"
+)
+
+// The catalog is the tree on page 0 of the file, it holds a record for every
+// table keyed by the table id. Records have a fixed size:
+// +------+------------+--------------------+--------------+
+// | name | numColumns | columns            | table header |
+// | 64B  |     1B     | MaxColumns * 33B   |     16B      |
+// +------+------------+--------------------+--------------+
+// name:    length 1B, name 63B
+// column:  length 1B, name 31B, type 1B
+// header:  root, first leaf, node count and key mode of the table's tree, 4B each
+
+const MaxTableNameSize = 63
+const MaxColumnNameSize = 31
+const MaxColumns = 16
+
+const columnRecordSize = 1 + MaxColumnNameSize + 1
+const tableRecordSize = 1 + MaxTableNameSize + 1 + MaxColumns*columnRecordSize + 16
+
+var ErrTableExists = errors.New("table already exists")
+var ErrNoSuchTable = errors.New("no such table")
+
+type Column struct {
+	Name string
+	Type datatype.Type
+}
+
+func (c Column) String() string {
+	return c.Name + " " + c.Type.String()
+}
+
+// The first column is the primary key of the rows. Keys are uint32 in the
+// trees, so it must be uint: an int column couldn't hold a negative id.
+func validateSchema(name string, columns []Column) error {
+	if name == "" || len(name) > MaxTableNameSize {
+		return fmt.Errorf("invalid table name %q, expected 1 to %d bytes", name, MaxTableNameSize)
+	}
+	if len(columns) == 0 || len(columns) > MaxColumns {
+		return fmt.Errorf("table %s has %d columns, expected 1 to %d", name, len(columns), MaxColumns)
+	}
+	if columns[0].Type != datatype.TypeUint {
+		return fmt.Errorf("the first column %s of table %s is the primary key, it must be uint", columns[0].Name, name)
+	}
+	seen := make(map[string]bool)
+	for _, c := range columns {
+		if c.Name == "" || len(c.Name) > MaxColumnNameSize {
+			return fmt.Errorf("invalid column name %q, expected 1 to %d bytes", c.Name, MaxColumnNameSize)
+		}
+		if c.Type >= datatype.TypeInvalid {
+			return fmt.Errorf("column %s has an invalid type", c.Name)
+		}
+		if seen[strings.ToLower(c.Name)] {
+			return fmt.Errorf("column %s is declared twice in table %s", c.Name, name)
+		}
+		seen[strings.ToLower(c.Name)] = true
+	}
+	return nil
+}
+
+func encodeTableRecord(name string, columns []Column, header btree.Header) []byte {
+	buf := make([]byte, tableRecordSize)
+	pos := 0
+	buf[pos] = byte(len(name))
+	copy(buf[pos+1:], name)
+	pos += 1 + MaxTableNameSize
+
+	buf[pos] = byte(len(columns))
+	pos++
+	for i := 0; i < MaxColumns; i++ {
+		if i < len(columns) {
+			buf[pos] = byte(len(columns[i].Name))
+			copy(buf[pos+1:], columns[i].Name)
+			buf[pos+1+MaxColumnNameSize] = byte(columns[i].Type)
+		}
+		pos += columnRecordSize
+	}
+
+	binary.LittleEndian.PutUint32(buf[pos:], uint32(header.Root))
+	binary.LittleEndian.PutUint32(buf[pos+4:], uint32(header.First))
+	binary.LittleEndian.PutUint32(buf[pos+8:], header.NumNode)
+	binary.LittleEndian.PutUint32(buf[pos+12:], uint32(header.KeyMode))
+	return buf
+}
+
+func decodeTableRecord(data []byte) (name string, columns []Column, header btree.Header, err error) {
+	if len(data) != tableRecordSize {
+		return "", nil, header, fmt.Errorf("decoding table record: invalid size %d, expected %d", len(data), tableRecordSize)
+	}
+	pos := 0
+	if n := int(data[pos]); n <= MaxTableNameSize {
+		name = string(data[pos+1 : pos+1+n])
+	} else {
+		return "", nil, header, fmt.Errorf("decoding table record: invalid name length %d", n)
+	}
+	pos += 1 + MaxTableNameSize
+
+	numColumns := int(data[pos])
+	if numColumns > MaxColumns {
+		return "", nil, header, fmt.Errorf("decoding table record %s: invalid column count %d", name, numColumns)
+	}
+	pos++
+	columns = make([]Column, numColumns)
+	for i := 0; i < MaxColumns; i++ {
+		if i < numColumns {
+			n := int(data[pos])
+			if n > MaxColumnNameSize {
+				return "", nil, header, fmt.Errorf("decoding table record %s: invalid column name length %d", name, n)
+			}
+			columns[i] = Column{
+				Name: string(data[pos+1 : pos+1+n]),
+				Type: datatype.Type(data[pos+1+MaxColumnNameSize]),
+			}
+		}
+		pos += columnRecordSize
+	}
+
+	header.Root = btree.PageNum(binary.LittleEndian.Uint32(data[pos:]))
+	header.First = btree.PageNum(binary.LittleEndian.Uint32(data[pos+4:]))
+	header.NumNode = binary.LittleEndian.Uint32(data[pos+8:])
+	header.KeyMode = btree.KeyMode(binary.LittleEndian.Uint32(data[pos+12:]))
+	return name, columns, header, nil
+}
+
+// Read every table of the catalog, replacing the tables loaded before
+func (db *DB) loadTables() error {
+	tables := make(map[string]*Table)
+	c := db.catalog.FullScan()
+	for ; c.Valid(); c.Next() {
+		name, columns, header, err := decodeTableRecord(c.Value())
+		if err != nil {
+			return fmt.Errorf("catalog entry %d: %w", c.Key(), err)
+		}
+		tables[name] = db.openTable(c.Key(), name, columns, header)
+	}
+	if c.Err() != nil {
+		return c.Err()
+	}
+	db.tables = tables
+	return nil
+}
+
+// The tree of the table stores its header in the table's catalog record
+func (db *DB) openTable(id uint32, name string, columns []Column, header btree.Header) *Table {
+	t := &Table{Name: name, Columns: columns, id: id}
+	t.BTree = db.catalog.OpenTree(header, func(header btree.Header) error {
+		return db.catalog.Update(t.id, encodeTableRecord(t.Name, t.Columns, header))
+	})
+	return t
+}
+
+// Returns the table with the name, nil if there's no such table.
+// The same instance is returned until the tables are reloaded by a rollback
+// or a vacuum, or the table is altered.
+func (db *DB) Table(name string) *Table {
+	return db.tables[name]
+}
+
+// Every table of the database, in the order they were created
+func (db *DB) Tables() []*Table {
+	tables := make([]*Table, 0, len(db.tables))
+	for _, t := range db.tables {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].id < tables[j].id })
+	return tables
+}
+
+// Declare a new empty table and store its schema in the catalog.
+// The first column is the primary key.
+func (db *DB) CreateTable(name string, columns []Column) (*Table, error) {
+	if _, ok := db.tables[name]; ok {
+		return nil, fmt.Errorf("creating table %s: %w", name, ErrTableExists)
+	}
+	if err := validateSchema(name, columns); err != nil {
+		return nil, fmt.Errorf("creating table %s: %w", name, err)
+	}
+
+	var id uint32 = 1
+	c := db.catalog.Cursor()
+	if c.Last(); c.Valid() {
+		id = c.Key() + 1
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
+	}
+
+	header := btree.Header{KeyMode: db.options.KeyMode}
+	if err := db.catalog.Insert(id, encodeTableRecord(name, columns, header)); err != nil {
+		return nil, fmt.Errorf("creating table %s: %w", name, err)
+	}
+	t := db.openTable(id, name, columns, header)
+	db.tables[name] = t
+	return t, nil
+}
+
+// Remove the table from the catalog, then free every page of its tree
+func (db *DB) DropTable(name string) error {
+	t, ok := db.tables[name]
+	if !ok {
+		return fmt.Errorf("dropping table %s: %w", name, ErrNoSuchTable)
+	}
+	if _, err := db.catalog.Delete(t.id); err != nil {
+		return fmt.Errorf("dropping table %s: %w", name, err)
+	}
+	delete(db.tables, name)
+	if err := db.freeTree(t.BTree.Header()); err != nil {
+		return fmt.Errorf("dropping table %s: %w", name, err)
+	}
+	return nil
+}
+
+// Free every page of a tree that's no longer in the catalog. Its header isn't
+// saved anywhere, so the pages it didn't free when it fails are leaked until
+// the next vacuum, which only copies the trees of the catalog.
+func (db *DB) freeTree(header btree.Header) error {
+	tree := db.catalog.OpenTree(header, func(btree.Header) error { return nil })
+	if err := tree.Drop(); err != nil {
+		return fmt.Errorf("freeing the pages of the old tree, they're leaked until a vacuum: %w", err)
+	}
+	return nil
+}
+
+// Replace the columns of the table. Every row is converted to the new columns
+// by convert and written to a new tree, which replaces the tree of the table
+// once every row converted, so a failed alter leaves the table as it was.
+// Returns the table with the new columns, along with the error when only
+// freeing the old tree failed.
+func (db *DB) AlterTable(name string, columns []Column, convert func(data []byte) ([]byte, error)) (*Table, error) {
+	t, ok := db.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("altering table %s: %w", name, ErrNoSuchTable)
+	}
+	if err := validateSchema(name, columns); err != nil {
+		return nil, fmt.Errorf("altering table %s: %w", name, err)
+	}
+
+	// the catalog keeps the old tree until the new one is complete
+	header := btree.Header{KeyMode: t.BTree.KeyMode}
+	rewritten := db.catalog.OpenTree(header, func(h btree.Header) error {
+		header = h
+		return nil
+	})
+	err := t.Scan(func(key uint32, data []byte) error {
+		converted, err := convert(data)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", key, err)
+		}
+		return rewritten.Insert(key, converted)
+	})
+	if err != nil {
+		if dropErr := rewritten.Drop(); dropErr != nil {
+			return nil, fmt.Errorf("altering table %s: %w, freeing the new tree: %w", name, err, dropErr)
+		}
+		return nil, fmt.Errorf("altering table %s: %w", name, err)
+	}
+	// the catalog points to the new tree before the old one is freed,
+	// so the rows are never lost
+	if err := db.catalog.Update(t.id, encodeTableRecord(name, columns, header)); err != nil {
+		if dropErr := rewritten.Drop(); dropErr != nil {
+			return nil, fmt.Errorf("altering table %s: %w, freeing the new tree: %w", name, err, dropErr)
+		}
+		return nil, fmt.Errorf("altering table %s: %w", name, err)
+	}
+	altered := db.openTable(t.id, name, columns, header)
+	db.tables[name] = altered
+	if err := db.freeTree(t.BTree.Header()); err != nil {
+		return altered, fmt.Errorf("altering table %s: %w", name, err)
+	}
+	return altered, nil
+}
+
+// A broken invariant found by Check, in the tree of Table, or in the catalog
+// and the pages of the file when Table is empty
+type Violation struct {
+	Table string
+	btree.Violation
+}
+
+func (v Violation) String() string {
+	if v.Table == "" {
+		return "catalog: " + v.Violation.String()
+	}
+	return "table " + v.Table + ": " + v.Violation.String()
+}
+
+// Verify the tree of every table, then the catalog with the freelist and
+// the accounting of every page of the file. Returns nil for a sound file.
+func (db *DB) Check() []Violation {
+	var violations []Violation
+	tables := db.Tables()
+	trees := make([]*btree.BTree, len(tables))
+	for i, t := range tables {
+		trees[i] = t.BTree
+		for _, v := range t.BTree.Check() {
+			violations = append(violations, Violation{Table: t.Name, Violation: v})
+		}
+	}
+	for _, v := range db.catalog.Check(trees...) {
+		violations = append(violations, Violation{Violation: v})
+	}
+	return violations
+}
+
+// Pages of the file on the freelist
+func (db *DB) NumFree() uint32 {
+	return db.catalog.NumFree
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/datatype"
+)
+
+var testColumns = []Column{
+	{Name: "id", Type: datatype.TypeUint},
+	{Name: "name", Type: datatype.TypeString},
+}
+
+// Open the database at path, it's closed when the test ends
+func openTestDB(t *testing.T, path string) *DB {
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Create the table with rows of 100 bytes keyed 1 to count, enough for a tree of a few levels
+func createTestTable(t *testing.T, db *DB, name string, count int) *Table {
+	table, err := db.CreateTable(name, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 1; key <= count; key++ {
+		if err := table.Persist(testRow(name, key), uint32(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return table
+}
+
+func testRow(table string, key int) []byte {
+	data := make([]byte, 100)
+	copy(data, fmt.Sprintf("%s %d", table, key))
+	return data
+}
+
+// Rows of the table keyed by their key
+func scanRows(t *testing.T, table *Table) map[uint32][]byte {
+	rows := make(map[uint32][]byte)
+	err := table.Scan(func(key uint32, data []byte) error {
+		rows[key] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func mustCheck(t *testing.T, db *DB) {
+	if violations := db.Check(); len(violations) > 0 {
+		t.Fatalf("Check found violations: %v", violations)
+	}
+}
+
+func TestTableRecord(t *testing.T) {
+	columns := make([]Column, MaxColumns)
+	for i := range columns {
+		columns[i] = Column{Name: fmt.Sprintf("c%d", i), Type: datatype.TypeString}
+	}
+	columns[0] = Column{Name: strings.Repeat("k", MaxColumnNameSize), Type: datatype.TypeUint}
+	columns[1].Type = datatype.TypeInt
+	name := strings.Repeat("t", MaxTableNameSize)
+	header := btree.Header{Root: 12, First: 34, NumNode: 56, KeyMode: btree.KeyModeDuplicate}
+
+	data := encodeTableRecord(name, columns, header)
+	if len(data) != tableRecordSize {
+		t.Fatalf("Table record has %d bytes, expected %d", len(data), tableRecordSize)
+	}
+	decodedName, decodedColumns, decodedHeader, err := decodeTableRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedName != name || !reflect.DeepEqual(decodedColumns, columns) || decodedHeader != header {
+		t.Fatalf("Decoded table record %s %v %+v, expected %s %v %+v", decodedName, decodedColumns, decodedHeader, name, columns, header)
+	}
+
+	if _, _, _, err := decodeTableRecord(data[1:]); err == nil {
+		t.Error("Decode table record: short record returned no error")
+	}
+	data[0] = MaxTableNameSize + 1
+	if _, _, _, err := decodeTableRecord(data); err == nil {
+		t.Error("Decode table record: name length out of the record returned no error")
+	}
+}
+
+func TestCreateTableErrors(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	createTestTable(t, db, "users", 0)
+
+	if _, err := db.CreateTable("users", testColumns); !errors.Is(err, ErrTableExists) {
+		t.Fatalf("CreateTable twice: found error %v, expected %v", err, ErrTableExists)
+	}
+	tooMany := make([]Column, MaxColumns+1)
+	for i := range tooMany {
+		tooMany[i] = Column{Name: fmt.Sprintf("c%d", i), Type: datatype.TypeUint}
+	}
+	tests := []struct {
+		name    string
+		table   string
+		columns []Column
+	}{
+		{"empty table name", "", testColumns},
+		{"long table name", strings.Repeat("t", MaxTableNameSize+1), testColumns},
+		{"no columns", "t", nil},
+		{"too many columns", "t", tooMany},
+		{"string primary key", "t", []Column{{Name: "id", Type: datatype.TypeString}}},
+		{"int primary key", "t", []Column{{Name: "id", Type: datatype.TypeInt}}},
+		{"empty column name", "t", []Column{{Name: "id", Type: datatype.TypeUint}, {Name: "", Type: datatype.TypeUint}}},
+		{"long column name", "t", []Column{{Name: strings.Repeat("c", MaxColumnNameSize+1), Type: datatype.TypeUint}}},
+		{"invalid type", "t", []Column{{Name: "id", Type: datatype.TypeUint}, {Name: "c", Type: datatype.TypeInvalid}}},
+		{"duplicate column", "t", []Column{{Name: "id", Type: datatype.TypeUint}, {Name: "ID", Type: datatype.TypeUint}}},
+	}
+	for _, test := range tests {
+		if _, err := db.CreateTable(test.table, test.columns); err == nil {
+			t.Errorf("CreateTable %s: expected an error", test.name)
+		}
+	}
+	if tables := db.Tables(); len(tables) != 1 {
+		t.Fatalf("Found %d tables after the failed creates, expected 1", len(tables))
+	}
+	mustCheck(t, db)
+}
+
+// The tables, their columns and their rows are read back from the catalog
+func TestCatalogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	columns := []Column{{Name: "id", Type: datatype.TypeUint}, {Name: "delta", Type: datatype.TypeInt}}
+	createTestTable(t, db, "users", 300)
+	if _, err := db.CreateTable("deltas", columns); err != nil {
+		t.Fatal(err)
+	}
+	createTestTable(t, db, "empty", 0)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, path)
+	var names []string
+	for _, table := range db.Tables() {
+		names = append(names, table.Name)
+	}
+	if expected := []string{"users", "deltas", "empty"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Reopened catalog has tables %v, expected %v", names, expected)
+	}
+	if deltas := db.Table("deltas"); !reflect.DeepEqual(deltas.Columns, columns) {
+		t.Fatalf("Reopened table deltas has columns %v, expected %v", deltas.Columns, columns)
+	}
+	rows := scanRows(t, db.Table("users"))
+	if len(rows) != 300 || !bytes.Equal(rows[150], testRow("users", 150)) {
+		t.Fatalf("Found %d rows in the reopened table users, expected 300", len(rows))
+	}
+	mustCheck(t, db)
+
+	// new tables get ids after the ones of the file
+	createTestTable(t, db, "orders", 10)
+	if tables := db.Tables(); tables[len(tables)-1].Name != "orders" {
+		t.Fatalf("New table is listed before %s", tables[len(tables)-1].Name)
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	createTestTable(t, db, "dropped", 300)
+	createTestTable(t, db, "kept", 100)
+
+	if err := db.DropTable("dropped"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Table("dropped") != nil {
+		t.Fatal("DropTable: table dropped is still loaded")
+	}
+	if db.NumFree() == 0 {
+		t.Fatal("DropTable: no page of the table was freed")
+	}
+	mustCheck(t, db)
+	if err := db.DropTable("dropped"); !errors.Is(err, ErrNoSuchTable) {
+		t.Fatalf("DropTable twice: found error %v, expected %v", err, ErrNoSuchTable)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the catalog entry stays removed, the other table is untouched
+	db = openTestDB(t, path)
+	if db.Table("dropped") != nil {
+		t.Fatal("DropTable: table dropped is back after reopening the file")
+	}
+	if rows := scanRows(t, db.Table("kept")); len(rows) != 100 {
+		t.Fatalf("Found %d rows in table kept, expected 100", len(rows))
+	}
+	mustCheck(t, db)
+
+	// the name is free again and the new table reuses the freed pages
+	numPages := db.pager.NumPages()
+	createTestTable(t, db, "dropped", 10)
+	if rows := scanRows(t, db.Table("dropped")); len(rows) != 10 {
+		t.Fatalf("Found %d rows in the new table dropped, expected 10", len(rows))
+	}
+	if db.pager.NumPages() != numPages {
+		t.Fatalf("File grew from %d to %d pages while free pages were left", numPages, db.pager.NumPages())
+	}
+	mustCheck(t, db)
+}
+
+func TestAlterTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, path)
+	createTestTable(t, db, "altered", 300)
+	createTestTable(t, db, "kept", 50)
+
+	columns := append(append([]Column{}, testColumns...), Column{Name: "age", Type: datatype.TypeUint})
+	altered, err := db.AlterTable("altered", columns, func(data []byte) ([]byte, error) {
+		return append(data, 42), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Table("altered") != altered || !reflect.DeepEqual(altered.Columns, columns) {
+		t.Fatalf("AlterTable: table has columns %v, expected %v", db.Table("altered").Columns, columns)
+	}
+	mustCheck(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new columns and the converted rows are in the file
+	db = openTestDB(t, path)
+	altered = db.Table("altered")
+	if !reflect.DeepEqual(altered.Columns, columns) {
+		t.Fatalf("Reopened table has columns %v, expected %v", altered.Columns, columns)
+	}
+	rows := scanRows(t, altered)
+	if len(rows) != 300 {
+		t.Fatalf("Found %d rows after altering, expected 300", len(rows))
+	}
+	for key, data := range rows {
+		if expected := append(testRow("altered", int(key)), 42); !bytes.Equal(data, expected) {
+			t.Fatalf("Row %d is %q, expected %q", key, data, expected)
+		}
+	}
+	if rows := scanRows(t, db.Table("kept")); len(rows) != 50 {
+		t.Fatalf("Found %d rows in table kept, expected 50", len(rows))
+	}
+	mustCheck(t, db)
+}
+
+// A row that fails to convert leaves the table as it was, the new tree is freed
+func TestAlterTableConvertError(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	table := createTestTable(t, db, "altered", 300)
+	header := table.BTree.Header()
+	numFree := db.NumFree()
+
+	columns := append(append([]Column{}, testColumns...), Column{Name: "age", Type: datatype.TypeUint})
+	convertErr := errors.New("can't convert")
+	_, err := db.AlterTable("altered", columns, func(data []byte) ([]byte, error) {
+		if bytes.HasPrefix(data, []byte("altered 250\x00")) {
+			return nil, convertErr
+		}
+		return append(data, 42), nil
+	})
+	if !errors.Is(err, convertErr) {
+		t.Fatalf("AlterTable: found error %v, expected %v", err, convertErr)
+	}
+
+	table = db.Table("altered")
+	if !reflect.DeepEqual(table.Columns, testColumns) || table.BTree.Header() != header {
+		t.Fatalf("AlterTable: failed alter changed the table to %v, tree %+v", table.Columns, table.BTree.Header())
+	}
+	rows := scanRows(t, table)
+	if len(rows) != 300 || !bytes.Equal(rows[250], testRow("altered", 250)) {
+		t.Fatalf("Found %d rows after a failed alter, expected the 300 rows unchanged", len(rows))
+	}
+	if db.NumFree() <= numFree {
+		t.Fatalf("AlterTable: %d free pages after a failed alter, expected the pages of the new tree freed", db.NumFree())
+	}
+	mustCheck(t, db)
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tomial/go-db/internal/btree"
+	"github.com/tomial/go-db/internal/pager"
+)
+
+var ErrInTransaction = errors.New("a transaction is already active")
+var ErrNoTransaction = errors.New("no transaction is active")
+
+// An open database file, the file handle is passed down to the pager and
+// the trees instead of each of them opening the file by name.
+// Every statement shares the same pager and trees, so the tree metadata
+// read by one statement is the one written by the previous.
+type DB struct {
+	Path    string
+	file    *os.File
+	pager   *pager.Pager
+	catalog *btree.BTree // tree on page 0, the tables are the other trees of the file
+	tables  map[string]*Table
+	options Options
+}
+
+// Open the database file at path, creating it if it doesn't exist
+func Open(path string, options Options) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	p, err := pager.Init(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	// a file of an older format gets no log created next to it
+	if err := p.CheckFormat(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	// recovers from a crash of a previous run before the tree is read
+	if err := openLog(p, path, options.JournalMode); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	catalog, err := btree.Open(p, btree.KeyModeUnique)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	db := &DB{
+		Path:    path,
+		file:    file,
+		pager:   p,
+		catalog: catalog,
+		options: options,
+	}
+	if err := db.loadTables(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// The options the database was opened with
+func (db *DB) Options() Options {
+	return db.options
+}
+
+// The write-ahead log of the database file at path
+func walPath(path string) string {
+	return path + "-wal"
+}
+
+// The rollback journal of the database file at path
+func journalPath(path string) string {
+	return path + "-journal"
+}
+
+// Recover the database file from a rollback journal or a write-ahead log
+// left by a crash, whatever the mode it was written in, then attach the
+// log of the journal mode to the pager
+func openLog(p *pager.Pager, path string, mode JournalMode) error {
+	if mode != JournalDelete && exists(journalPath(path)) {
+		if err := p.OpenJournal(journalPath(path)); err != nil {
+			return err
+		}
+		if err := p.CloseJournal(); err != nil {
+			return err
+		}
+	}
+	if mode != JournalWAL && exists(walPath(path)) {
+		if err := p.OpenWAL(walPath(path)); err != nil {
+			return err
+		}
+		if err := p.CloseWAL(); err != nil {
+			return err
+		}
+	}
+	switch mode {
+	case JournalWAL:
+		return p.OpenWAL(walPath(path))
+	case JournalDelete:
+		return p.OpenJournal(journalPath(path))
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Rebuild every tree into a new file next to the database, then rename it over
+// the database file, so the file is either the old one or the compacted one.
+// Returns the file size before and after.
+func (db *DB) Vacuum() (before int64, after int64, err error) {
+	if db.pager.InTransaction() {
+		return 0, 0, fmt.Errorf("vacuum: %w", ErrInTransaction)
+	}
+	if err := db.pager.Flush(); err != nil {
+		return 0, 0, err
+	}
+	// the db file holds every page and the log is empty from here on
+	if err := db.pager.Checkpoint(); err != nil {
+		return 0, 0, err
+	}
+	fstat, err := db.pager.Fstat()
+	if err != nil {
+		return 0, 0, err
+	}
+	before = fstat.Size()
+
+	path := db.Path + "-vacuum"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, 0, fmt.Errorf("vacuum: creating %s: %w", path, err)
+	}
+	p, catalog, err := db.compactInto(file)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return 0, 0, fmt.Errorf("vacuum: %w", err)
+	}
+	fstat, err = p.Fstat()
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return 0, 0, fmt.Errorf("vacuum: %w", err)
+	}
+	after = fstat.Size()
+
+	if err := os.Rename(path, db.Path); err != nil {
+		file.Close()
+		os.Remove(path)
+		return 0, 0, fmt.Errorf("vacuum: replacing %s: %w", db.Path, err)
+	}
+	syncDir(filepath.Dir(db.Path))
+
+	// the open file was renamed, it's the database file now
+	oldFile, oldPager := db.file, db.pager
+	db.file, db.pager, db.catalog = file, p, catalog
+	if err := db.loadTables(); err != nil {
+		return 0, 0, fmt.Errorf("vacuum: %w", err)
+	}
+	// the old log is empty, it's removed so the new file starts its own
+	err = oldPager.CloseWAL()
+	oldFile.Close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("vacuum: %w", err)
+	}
+	if err := openLog(p, db.Path, db.options.JournalMode); err != nil {
+		return 0, 0, fmt.Errorf("vacuum: %w", err)
+	}
+	return before, after, nil
+}
+
+// Write a compacted copy of every table to the empty file and sync it.
+// The catalog comes first, then the tables one after the other.
+func (db *DB) compactInto(file *os.File) (*pager.Pager, *btree.BTree, error) {
+	p, err := pager.Init(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	catalog, err := btree.Open(p, btree.KeyModeUnique)
+	if err != nil {
+		return nil, nil, err
+	}
+	tables := db.Tables()
+	for _, t := range tables {
+		if err := catalog.Insert(t.id, encodeTableRecord(t.Name, t.Columns, btree.Header{})); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, t := range tables {
+		t := t
+		_, err := t.BTree.CompactInto(catalog, func(header btree.Header) error {
+			return catalog.Update(t.id, encodeTableRecord(t.Name, t.Columns, header))
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("table %s: %w", t.Name, err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return p, catalog, nil
+}
+
+// Sync the directory so a rename in it is durable, not every platform supports it
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// Write the pages changed by the statements since the last flush to the file,
+// in a transaction they're written by Commit instead
+func (db *DB) Flush() error {
+	if db.pager.InTransaction() {
+		return nil
+	}
+	return db.pager.Flush()
+}
+
+// Start a transaction, the statements until Commit or Rollback are applied
+// all together or not at all
+func (db *DB) Begin() error {
+	if db.pager.InTransaction() {
+		return ErrInTransaction
+	}
+	return db.pager.Begin()
+}
+
+func (db *DB) Commit() error {
+	if !db.pager.InTransaction() {
+		return ErrNoTransaction
+	}
+	return db.pager.Commit()
+}
+
+// Discard the changes of the transaction, the trees are read back as they
+// were when it began
+func (db *DB) Rollback() error {
+	if !db.pager.InTransaction() {
+		return ErrNoTransaction
+	}
+	db.pager.Rollback()
+	if err := db.catalog.Reload(); err != nil {
+		return err
+	}
+	return db.loadTables()
+}
+
+func (db *DB) InTransaction() bool {
+	return db.pager.InTransaction()
+}
+
+// Counters of the pager's buffer pool
+func (db *DB) Stats() pager.Stats {
+	return db.pager.Stats()
+}
+
+// Flush, checkpoint and remove the write-ahead log, then close the file.
+// A transaction that isn't committed is rolled back.
+func (db *DB) Close() error {
+	db.pager.Rollback()
+	err := db.pager.Flush()
+	if err == nil {
+		err = db.pager.CloseWAL()
+	}
+	if closeErr := db.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tomial/go-db/internal/constants"
+	"github.com/tomial/go-db/internal/pager"
+)
+
+// Files of the older formats with the row 1 a a@b, as they were written:
+// the bytes of each page that aren't zero, by their offset in the page
+var legacyFiles = []struct {
+	name  string
+	pages []map[int]string
+}{
+	{
+		// the tree fields right after the magic number, no checksum
+		name: "without checksums",
+		pages: []map[int]string{
+			{0: "abc0010000000100000001000000"},
+			{0: "abc1020000000000000000010000000c0200000001010000000100000000000000000061", 0x122: "614062"},
+		},
+	},
+	{
+		// checksummed pages, the catalog on page 0, fixed-size leaf cells
+		name: "with fixed-size leaf cells",
+		pages: []map[int]string{
+			{0: "abc01d62cf8a010000000100000001"},
+		},
+	},
+}
+
+func TestOpenLegacyFormat(t *testing.T) {
+	for _, file := range legacyFiles {
+		t.Run(file.name, func(t *testing.T) {
+			data := make([]byte, len(file.pages)*int(constants.PageSize))
+			for i, page := range file.pages {
+				for offset, content := range page {
+					decoded, err := hex.DecodeString(content)
+					if err != nil {
+						t.Fatal(err)
+					}
+					copy(data[i*int(constants.PageSize)+offset:], decoded)
+				}
+			}
+			path := filepath.Join(t.TempDir(), "my.db")
+			if err := os.WriteFile(path, data, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(path, Options{})
+			if !errors.Is(err, pager.ErrUnsupportedFormat) {
+				t.Fatalf("Open: found error %v, expected %v", err, pager.ErrUnsupportedFormat)
+			}
+			if db != nil {
+				t.Fatal("Open: returned a database for a file of an older format")
+			}
+			// the file is left as it was, without a log next to it
+			if written, err := os.ReadFile(path); err != nil || !bytes.Equal(written, data) {
+				t.Fatalf("Open: file of an older format was modified, error %v", err)
+			}
+			if _, err := os.Stat(walPath(path)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("Open: created %s next to a file of an older format", walPath(path))
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tomial/go-db/internal/btree"
+)
+
+type Options struct {
+	KeyMode     btree.KeyMode // key mode of the tables created
+	JournalMode JournalMode
+}
+
+// How the pages written by a flush survive a crash in the middle of it
+type JournalMode uint8
+
+const (
+	JournalWAL    JournalMode = iota // Append the pages to my.db-wal, checkpoint them later
+	JournalDelete                    // Copy the original pages to my.db-journal, delete it after the flush
+	JournalOff                       // Overwrite the pages in place, a crash can corrupt the file
+)
+
+func (m JournalMode) String() string {
+	switch m {
+	case JournalWAL:
+		return "wal"
+	case JournalDelete:
+		return "delete"
+	case JournalOff:
+		return "off"
+	}
+	return fmt.Sprintf("JournalMode(%d)", uint8(m))
+}
+
+func ParseJournalMode(s string) (JournalMode, error) {
+	for _, m := range []JournalMode{JournalWAL, JournalDelete, JournalOff} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid journal_mode %q, expected delete, wal or off", s)
+}
+
+// Parse open options written as name=value, e.g. journal_mode=delete
+func ParseOptions(args []string) (Options, error) {
+	var options Options
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return options, fmt.Errorf("invalid option %q, expected name=value", arg)
+		}
+		switch name {
+		case "journal_mode":
+			mode, err := ParseJournalMode(value)
+			if err != nil {
+				return options, err
+			}
+			options.JournalMode = mode
+		default:
+			return options, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return options, nil
+}
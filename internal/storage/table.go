@@ -3,27 +3,59 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/tomial/go-db/internal/btree"
 )
 
 type Table struct {
-	Name   string
-	BTree  *btree.BTree
-	RowNum uint32
+	Name    string
+	Columns []Column
+	BTree   *btree.BTree
+	id      uint32 // key of the table's record in the catalog
 }
 
+// Columns of the table as declared by create table, e.g. id uint, name string
+func (t *Table) Schema() string {
+	columns := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		columns[i] = c.String()
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Insert a new row, returns btree.ErrDuplicateKey if the key exists
 func (t *Table) Persist(data []byte, key uint32) error {
-	t.BTree.Insert(key, data)
+	if key == 0 {
+		return errors.New("persisting data: invalid index 0")
+	}
+	return t.BTree.Insert(key, data)
+}
+
+// Overwrite the row with the key, returns btree.ErrKeyNotFound if there's no such row
+func (t *Table) Update(data []byte, key uint32) error {
+	if key == 0 {
+		return errors.New("updating data: invalid index 0")
+	}
+	return t.BTree.Update(key, data)
+}
 
-	return nil
+// Overwrite the row with the key, or insert it if there's no such row
+func (t *Table) Replace(data []byte, key uint32) (replaced bool, err error) {
+	if key == 0 {
+		return false, errors.New("replacing data: invalid index 0")
+	}
+	return t.BTree.Upsert(key, data)
 }
 
 func (t *Table) Load(key uint32) ([]byte, error) {
 	if key == 0 {
 		return nil, errors.New("loading data: invalid index 0")
 	}
-	found, data := t.BTree.Search(key)
+	found, data, err := t.BTree.Search(key)
+	if err != nil {
+		return nil, err
+	}
 	if found {
 		return data, nil
 	} else {
@@ -31,12 +63,38 @@ func (t *Table) Load(key uint32) ([]byte, error) {
 	}
 }
 
-func InitTable(name string) *Table {
-	btree := btree.NewBtree()
-	return &Table{
-		Name:  name,
-		BTree: btree,
+// Call fn with every row in key order, stops at the first error
+func (t *Table) Scan(fn func(key uint32, data []byte) error) error {
+	c := t.BTree.FullScan()
+	for ; c.Valid(); c.Next() {
+		err := fn(c.Key(), c.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// Call fn with the rows between lower and upper, in key order or reverse order.
+// Stops at the first error
+func (t *Table) Range(lower, upper btree.Bound, reverse bool, fn func(key uint32, data []byte) error) error {
+	var err error
+	rangeErr := t.BTree.Range(lower, upper, reverse, func(key uint32, data []byte) bool {
+		err = fn(key, data)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return rangeErr
+}
+
+// Remove the row with the key, returns false if there's no such row
+func (t *Table) Remove(key uint32) (bool, error) {
+	if key == 0 {
+		return false, errors.New("removing data: invalid index 0")
 	}
+	return t.BTree.Delete(key)
 }
 
 func (t *Table) String() string {